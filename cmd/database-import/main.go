@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"log"
+	"os"
+
+	"github.com/DMarby/picsum-photos/internal/database"
+	"github.com/DMarby/picsum-photos/internal/database/sqlite"
+)
+
+// Comandline flags
+var (
+	databaseFilePath   = flag.String("database-file-path", "./metadata.json", "path to the database file to import")
+	databaseSQLitePath = flag.String("database-sqlite-path", "./picsum.db", "path to the sqlite database to import into, created if it doesn't exist")
+)
+
+func main() {
+	flag.Parse()
+
+	data, err := os.ReadFile(*databaseFilePath)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var images []database.Image
+	if err := json.Unmarshal(data, &images); err != nil {
+		log.Fatal(err)
+	}
+
+	db, err := sqlite.New(*databaseSQLitePath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+
+	// Replaces the images in the database, keeping the existing ones if the import fails
+	if err := db.Import(context.Background(), images); err != nil {
+		log.Fatal(err)
+	}
+
+	log.Printf("imported %d images into %s", len(images), *databaseSQLitePath)
+}
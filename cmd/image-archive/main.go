@@ -0,0 +1,46 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"log"
+	"path/filepath"
+
+	"github.com/DMarby/picsum-photos/internal/atomicfile"
+	"github.com/DMarby/picsum-photos/internal/storage/archive"
+)
+
+// Comandline flags
+var (
+	imagePath   = flag.String("image-path", ".", "path to image directory")
+	archivePath = flag.String("archive-path", "./images.zip", "path to the archive to create")
+)
+
+func main() {
+	flag.Parse()
+
+	if err := run(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// run builds the archive, the temporary file is removed if building it fails
+func run() error {
+	resolvedArchivePath, err := filepath.Abs(*archivePath)
+	if err != nil {
+		return err
+	}
+
+	// Write the archive atomically, so that an image-service watching it never loads a partially written one
+	var count int
+	err = atomicfile.Write(resolvedArchivePath, 0644, func(w io.Writer) (err error) {
+		count, err = archive.Build(w, *imagePath)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Printf("wrote %d images to %s", count, resolvedArchivePath)
+	return nil
+}
@@ -1,6 +1,9 @@
 package main
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"flag"
 	"fmt"
@@ -8,6 +11,8 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
 
 	"github.com/DMarby/picsum-photos/internal/database"
 
@@ -45,19 +50,43 @@ func main() {
 			log.Fatal(err)
 		}
 
-		reader, err := os.Open(resolvedImagePath)
+		imageData, err := os.ReadFile(resolvedImagePath)
 		if err != nil {
 			log.Fatal(err)
 		}
-		defer reader.Close()
 
-		imageMetadata, _, err := image.DecodeConfig(reader)
+		imageMetadata, _, err := image.DecodeConfig(bytes.NewReader(imageData))
 		if err != nil {
 			log.Fatal(err)
 		}
 
 		images[i].Width = imageMetadata.Width
 		images[i].Height = imageMetadata.Height
+		images[i].SHA256 = checksum(imageData)
+
+		// Resized variants are stored as {id}_{size}.jpg, where size is the bucket of their largest dimension, see image.Task.SourceKey
+		variantPaths, err := filepath.Glob(filepath.Join(*imagePath, fmt.Sprintf("%s_*.jpg", img.ID)))
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		images[i].VariantSHA256 = nil
+		for _, variantPath := range variantPaths {
+			size, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(filepath.Base(variantPath), img.ID+"_"), ".jpg"))
+			if err != nil {
+				continue
+			}
+
+			variantData, err := os.ReadFile(variantPath)
+			if err != nil {
+				log.Fatal(err)
+			}
+
+			if images[i].VariantSHA256 == nil {
+				images[i].VariantSHA256 = make(map[int]string)
+			}
+			images[i].VariantSHA256[size] = checksum(variantData)
+		}
 	}
 
 	file, _ := os.OpenFile(resolvedManifestPath, os.O_WRONLY, 0644)
@@ -71,3 +100,8 @@ func main() {
 		log.Fatal(err)
 	}
 }
+
+func checksum(data []byte) string {
+	hash := sha256.Sum256(data)
+	return hex.EncodeToString(hash[:])
+}
@@ -3,24 +3,40 @@ package main
 import (
 	"context"
 	"flag"
+	"fmt"
 	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"runtime"
 	"strings"
 	"syscall"
+	"time"
 
+	"github.com/DMarby/picsum-photos/internal/admin"
+	"github.com/DMarby/picsum-photos/internal/cache"
+	"github.com/DMarby/picsum-photos/internal/cache/disk"
 	"github.com/DMarby/picsum-photos/internal/cache/memory"
+	"github.com/DMarby/picsum-photos/internal/cache/redis"
 	"github.com/DMarby/picsum-photos/internal/cmd"
+	"github.com/DMarby/picsum-photos/internal/database"
 	"github.com/DMarby/picsum-photos/internal/health"
 	"github.com/DMarby/picsum-photos/internal/hmac"
 	"github.com/DMarby/picsum-photos/internal/image"
 	"github.com/DMarby/picsum-photos/internal/image/vips"
+	"github.com/DMarby/picsum-photos/internal/image/worker"
 	"github.com/DMarby/picsum-photos/internal/logger"
 	"github.com/DMarby/picsum-photos/internal/metrics"
+	"github.com/DMarby/picsum-photos/internal/peers"
+	"github.com/DMarby/picsum-photos/internal/storage"
+	"github.com/DMarby/picsum-photos/internal/storage/archive"
 	"github.com/DMarby/picsum-photos/internal/storage/file"
+	"github.com/DMarby/picsum-photos/internal/storage/origin"
+	"github.com/DMarby/picsum-photos/internal/storage/s3"
 	"github.com/DMarby/picsum-photos/internal/tracing/test"
+	"github.com/DMarby/picsum-photos/internal/watch"
 
+	fileDatabase "github.com/DMarby/picsum-photos/internal/database/file"
 	api "github.com/DMarby/picsum-photos/internal/imageapi"
 
 	"github.com/jamiealquiza/envy"
@@ -35,14 +51,75 @@ var (
 	metricsListen = flag.String("metrics-listen", "127.0.0.1:8083", "metrics listen address")
 	loglevel      = zap.LevelFlag("log-level", zap.InfoLevel, "log level (default \"info\") (debug, info, warn, error, dpanic, panic, fatal)")
 
+	// Storage
+	storageBackends  = flag.String("storage", "file", "comma separated list of storage backends to load images from, in order (file, s3, origin, archive)")
+	storageWriteBack = flag.Bool("storage-write-back", false, "write images loaded from a later storage backend back to the first writable one, such as file")
+
+	storageChecksumsPath     = flag.String("storage-checksums-path", "", "path to an image manifest with checksums to verify images against when loading them (disabled if empty)")
+	storageVerifySampleRate  = flag.Float64("storage-verify-sample-rate", 1, "fraction of image loads to verify against their checksums, from 0 to 1")
+	storageChecksumsInterval = flag.Duration("storage-checksums-reload-interval", time.Minute, "how often to check the image manifest with checksums for changes, reloading them when it has changed (0 to disable)")
+
 	// Storage - File
 	storagePath = flag.String("storage-path", "", "path to the storage directory")
 
+	// Storage - Archive
+	storageArchivePath     = flag.String("storage-archive-path", "", "path to an image archive built with image-archive")
+	storageArchiveInterval = flag.Duration("storage-archive-reload-interval", 30*time.Second, "how often to check the image archive for changes, reloading it when it has been replaced")
+
+	// Storage - S3
+	storageS3Endpoint        = flag.String("storage-s3-endpoint", "https://s3.us-east-1.amazonaws.com", "url of the s3-compatible object storage")
+	storageS3Region          = flag.String("storage-s3-region", "us-east-1", "region of the s3 bucket")
+	storageS3Bucket          = flag.String("storage-s3-bucket", "", "name of the s3 bucket")
+	storageS3Prefix          = flag.String("storage-s3-prefix", "", "prefix for the image keys in the s3 bucket, such as images/")
+	storageS3AccessKeyID     = flag.String("storage-s3-access-key-id", "", "s3 access key id (requests are unauthenticated if empty)")
+	storageS3SecretAccessKey = flag.String("storage-s3-secret-access-key", "", "s3 secret access key")
+
+	// Storage - Origin
+	storageOriginURL              = flag.String("storage-origin-url", "", "url template to fetch images from an http origin, with {id} replaced by the image id, such as https://origin.example.com/images/{id}.jpg")
+	storageOriginTimeout          = flag.Duration("storage-origin-timeout", 10*time.Second, "timeout for requests to the http origin")
+	storageOriginBreakerThreshold = flag.Int("storage-origin-breaker-threshold", 5, "consecutive failed requests after which the http origin is considered down")
+	storageOriginBreakerCooldown  = flag.Duration("storage-origin-breaker-cooldown", 10*time.Second, "how long to fail requests immediately once the http origin is considered down")
+
 	// HMAC
 	hmacKey = flag.String("hmac-key", "", "hmac key to use for authentication between services")
 
+	// Admin
+	adminToken = flag.String("admin-token", "", "bearer token for the admin api on the metrics listener (disabled if empty)")
+
 	// Image processor
-	workers = flag.Int("workers", 3, "worker queue concurrency")
+	workers        = flag.Int("workers", 3, "worker queue concurrency")
+	clientIPHeader = flag.String("client-ip-header", "", "header to read the client ip from for fair queuing, such as X-Forwarded-For (defaults to the remote address)")
+
+	// Source image cache
+	cacheSize        = flag.Int64("cache-size", 1<<30, "maximum size in bytes of the source image cache")
+	cacheTTL         = flag.Duration("cache-ttl", 7*24*time.Hour, "how long to keep source images in the cache, must be above -cache-max-age so that stale images can be served while they're reloaded (0 to keep them until evicted)")
+	cacheNegativeTTL = flag.Duration("cache-negative-ttl", 30*time.Second, "how long to remember that a source image doesn't exist in the storage (0 to disable)")
+	cacheMaxAge      = flag.Duration("cache-max-age", 24*time.Hour, "how long cached source images are fresh for, after which they're reloaded from the storage in the background (0 to disable)")
+
+	// Source image cache - Disk
+	cacheDiskPath = flag.String("cache-disk-path", "", "path to the directory for the source image disk cache, between the in-memory cache and redis (disabled if empty)")
+	cacheDiskSize = flag.Int64("cache-disk-size", 10<<30, "maximum size in bytes of the source image disk cache")
+
+	// Source image cache - Redis
+	cacheRedisURL     = flag.String("cache-redis-url", "", "url of a redis server to share the source image cache between instances, behind the in-memory and disk caches, such as redis://localhost:6379/0 (disabled if empty)")
+	cacheRedisTimeout = flag.Duration("cache-redis-timeout", time.Second, "timeout for redis operations, after which the image is loaded from the storage instead")
+
+	// Processed image cache
+	imageCacheSize = flag.Int64("image-cache-size", 1<<30, "maximum size in bytes of the processed image cache")
+	imageCacheTTL  = flag.Duration("image-cache-ttl", 10*time.Minute, "how long to keep processed images in the cache")
+
+	// Processed image disk cache
+	imageDiskCachePath = flag.String("image-disk-cache-path", "", "path to the directory for the processed image disk cache (disabled if empty)")
+	imageDiskCacheSize = flag.Int64("image-disk-cache-size", 10<<30, "maximum size in bytes of the processed image disk cache")
+
+	// Peers
+	peerList = flag.String("peers", "", "comma separated list of the base urls of all image-service instances to share processed images with, such as http://10.0.0.1:8081 (disabled if empty)")
+	peerSelf = flag.String("peer-self", "", "base url of this instance, as it appears in -peers")
+
+	// Worker processes
+	workerProcesses   = flag.Bool("worker-processes", false, "process images in separate worker processes, so that crashes in libvips don't take down the service")
+	workerMemoryLimit = flag.Int64("worker-memory-limit", 1<<30, "memory limit in bytes for each worker process")
+	vipsWorker        = flag.Bool("vips-worker", false, "run as a worker process (used internally by -worker-processes)")
 )
 
 func main() {
@@ -58,6 +135,12 @@ func main() {
 	log := logger.New(*loglevel)
 	defer log.Sync()
 
+	// Run as a worker process for the image processor
+	if *vipsWorker {
+		runWorker(log)
+		return
+	}
+
 	// Set GOMAXPROCS
 	maxprocs.Set(maxprocs.Logger(log.Infof))
 
@@ -77,26 +160,114 @@ func main() {
 	tracer := test.Tracer(log)
 
 	// Initialize the storage
-	storage, err := file.New(*storagePath)
-	if err != nil {
-		log.Fatalf("error initializing storage: %s", err)
+	var storageProviders []storage.Provider
+	for _, backend := range strings.Split(*storageBackends, ",") {
+		storageProvider, err := newStorage(shutdownCtx, log, strings.TrimSpace(backend))
+		if err != nil {
+			log.Fatalf("error initializing %s storage: %s", backend, err)
+		}
+		storageProviders = append(storageProviders, storageProvider)
+	}
+
+	chain := &storage.Chain{Providers: storageProviders, WriteBack: *storageWriteBack}
+	var storageProvider storage.Provider = chain
+	if len(storageProviders) == 1 {
+		storageProvider = storageProviders[0]
+	}
+
+	if *storageChecksumsPath != "" {
+		manifest, err := fileDatabase.New(*storageChecksumsPath)
+		if err != nil {
+			log.Fatalf("error loading checksums: %s", err)
+		}
+
+		checksums, err := loadChecksums(ctx, manifest)
+		if err != nil {
+			log.Fatalf("error loading checksums: %s", err)
+		}
+
+		verified := &storage.Verified{Provider: storageProvider, Checksums: checksums, SampleRate: *storageVerifySampleRate}
+		// Always verify images before they're written back, regardless of the sample rate
+		chain.Verifier = verified
+		storageProvider = verified
+
+		// Reload the checksums when the manifest changes, so that new and replaced images don't fail verification until a restart
+		if *storageChecksumsInterval > 0 {
+			go watch.File(shutdownCtx, log, *storageChecksumsPath, *storageChecksumsInterval, manifest.Info, func() error {
+				if err := manifest.Reload(); err != nil {
+					return err
+				}
+
+				checksums, err := loadChecksums(shutdownCtx, manifest)
+				if err != nil {
+					return err
+				}
+
+				verified.SetChecksums(checksums)
+				return nil
+			})
+		}
 	}
 
 	// Initialize the cache
-	cache := memory.New()
-	defer cache.Shutdown()
+	// Images have to stay cached after they become stale, otherwise they expire instead of being served while they're reloaded
+	if *cacheTTL > 0 && *cacheMaxAge > 0 && *cacheMaxAge >= *cacheTTL {
+		log.Fatalf("-cache-max-age (%s) must be below -cache-ttl (%s)", *cacheMaxAge, *cacheTTL)
+	}
+
+	// Keep the most recently used images in memory, in front of the disk and redis
+	cacheProviders := []cache.Provider{memory.New(*cacheSize, *cacheTTL)}
+	if *cacheDiskPath != "" {
+		diskCache, err := disk.New("source", *cacheDiskPath, *cacheDiskSize)
+		if err != nil {
+			log.Fatalf("error initializing source disk cache: %s", err)
+		}
+		cacheProviders = append(cacheProviders, diskCache)
+	}
+	if *cacheRedisURL != "" {
+		// The tiers above already serve images while redis is unavailable, so it doesn't need a fallback of its own
+		redisCache, err := redis.New(*cacheRedisURL, *cacheTTL, *cacheRedisTimeout, nil)
+		if err != nil {
+			log.Fatalf("error initializing redis cache: %s", err)
+		}
+		cacheProviders = append(cacheProviders, redisCache)
+	}
+
+	var cacheProvider cache.Provider = &cache.Tiered{Providers: cacheProviders}
+	if len(cacheProviders) == 1 {
+		cacheProvider = cacheProviders[0]
+	}
+	defer cacheProvider.Shutdown()
+	sourceCache := image.NewCache(tracer, cacheProvider, storageProvider, *cacheNegativeTTL, *cacheMaxAge)
 
 	// Initialize the image processor
-	imageProcessor, err := vips.New(shutdownCtx, log, tracer, *workers, image.NewCache(tracer, cache, storage))
-	if err != nil {
-		log.Fatalf("error initializing image processor %s", err.Error())
+	var (
+		imageProcessor image.Processor
+		err            error
+	)
+	if *workerProcesses {
+		executable, err := os.Executable()
+		if err != nil {
+			log.Fatalf("error finding executable for worker processes: %s", err)
+		}
+
+		command := []string{executable, "-vips-worker", fmt.Sprintf("-worker-memory-limit=%d", *workerMemoryLimit), fmt.Sprintf("-log-level=%s", *loglevel)}
+		imageProcessor, err = worker.New(shutdownCtx, log, tracer, *workers, command, sourceCache)
+		if err != nil {
+			log.Fatalf("error initializing image processor %s", err.Error())
+		}
+	} else {
+		imageProcessor, err = vips.New(shutdownCtx, log, tracer, *workers, sourceCache)
+		if err != nil {
+			log.Fatalf("error initializing image processor %s", err.Error())
+		}
 	}
 
 	// Initialize and start the health checker
 	checker := &health.Checker{
 		Ctx:     shutdownCtx,
-		Storage: storage,
-		Cache:   cache,
+		Storage: storageProvider,
+		Cache:   cacheProvider,
 		Log:     log,
 	}
 	go checker.Run()
@@ -104,7 +275,27 @@ func main() {
 	// Start and listen on http
 	api := api.NewAPI(imageProcessor, log, tracer, cmd.HandlerTimeout, &hmac.HMAC{
 		Key: []byte(*hmacKey),
-	})
+	}, *imageCacheSize, *imageCacheTTL)
+	api.ClientIPHeader = *clientIPHeader
+
+	if *imageDiskCachePath != "" {
+		diskCache, err := disk.New("processed", *imageDiskCachePath, *imageDiskCacheSize)
+		if err != nil {
+			log.Fatalf("error initializing disk cache: %s", err)
+		}
+		defer diskCache.Shutdown()
+
+		api.DiskCache = diskCache
+	}
+
+	if *peerList != "" {
+		if *peerSelf == "" {
+			log.Fatalf("-peer-self is required when using -peers")
+		}
+
+		api.Peers = peers.New(*peerSelf, strings.Split(*peerList, ","), api.HMAC)
+	}
+
 	server := &http.Server{
 		Handler:      api.Router(),
 		ReadTimeout:  cmd.ReadTimeout,
@@ -137,7 +328,19 @@ func main() {
 	log.Infof("http server listening on %s", *listen)
 
 	// Start the metrics http server
-	go metrics.Serve(shutdownCtx, log, checker, *metricsListen)
+	var adminHandler http.Handler
+	if *adminToken != "" {
+		adminHandler = (&admin.API{
+			Token: *adminToken,
+			Log:   log,
+			Caches: map[string]admin.Cache{
+				"processed": api,
+				"source":    sourceCache,
+			},
+		}).Router()
+	}
+
+	go metrics.Serve(shutdownCtx, log, checker, adminHandler, *metricsListen)
 
 	// Wait for shutdown
 	<-shutdownCtx.Done()
@@ -150,3 +353,57 @@ func main() {
 		log.Warnf("error shutting down: %s", err)
 	}
 }
+
+// runWorker processes images from the parent image-service process until it goes away
+func runWorker(log *logger.Logger) {
+	if err := worker.LimitMemory(*workerMemoryLimit); err != nil {
+		log.Fatalf("error limiting worker memory: %s", err)
+	}
+
+	// Process all the images on the same thread, like the workers in the queue
+	runtime.LockOSThread()
+
+	if err := vips.Initialize(log); err != nil {
+		log.Fatalf("error initializing vips: %s", err)
+	}
+
+	tracer := test.Tracer(log)
+	err := worker.Serve(func(task *image.Task, buffer []byte) ([]byte, error) {
+		return vips.Transform(context.Background(), tracer, task, buffer)
+	})
+	if err != nil {
+		log.Fatalf("error running worker: %s", err)
+	}
+}
+
+// newStorage returns the storage provider for a storage backend
+func newStorage(ctx context.Context, log *logger.Logger, backend string) (storage.Provider, error) {
+	switch backend {
+	case "file":
+		return file.New(*storagePath)
+	case "archive":
+		provider, err := archive.New(*storageArchivePath)
+		if err != nil {
+			return nil, err
+		}
+
+		go provider.Watch(ctx, log, *storageArchiveInterval)
+		return provider, nil
+	case "s3":
+		return s3.New(*storageS3Endpoint, *storageS3Region, *storageS3Bucket, *storageS3Prefix, *storageS3AccessKeyID, *storageS3SecretAccessKey)
+	case "origin":
+		return origin.New(*storageOriginURL, *storageOriginTimeout, *storageOriginBreakerThreshold, *storageOriginBreakerCooldown)
+	default:
+		return nil, fmt.Errorf("unknown storage backend %s", backend)
+	}
+}
+
+// loadChecksums returns the image checksums from the image manifest
+func loadChecksums(ctx context.Context, manifest *fileDatabase.Provider) (map[string]string, error) {
+	images, err := manifest.ListAll(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return database.Checksums(images), nil
+}
@@ -9,6 +9,7 @@ import (
 	"os/signal"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/DMarby/picsum-photos/internal/api"
 	"github.com/DMarby/picsum-photos/internal/cmd"
@@ -16,7 +17,9 @@ import (
 	"github.com/DMarby/picsum-photos/internal/metrics"
 	"github.com/DMarby/picsum-photos/internal/tracing/test"
 
+	"github.com/DMarby/picsum-photos/internal/database"
 	fileDatabase "github.com/DMarby/picsum-photos/internal/database/file"
+	"github.com/DMarby/picsum-photos/internal/database/sqlite"
 	"github.com/DMarby/picsum-photos/internal/health"
 	"github.com/DMarby/picsum-photos/internal/logger"
 
@@ -34,8 +37,15 @@ var (
 	imageServiceURL = flag.String("image-service-url", "https://fastly.picsum.photos", "image service url")
 	loglevel        = zap.LevelFlag("log-level", zap.InfoLevel, "log level (default \"info\") (debug, info, warn, error, dpanic, panic, fatal)")
 
+	// Database
+	databaseBackend = flag.String("database", "file", "database backend to use (file, sqlite)")
+
 	// Database - File
-	databaseFilePath = flag.String("database-file-path", "./test/fixtures/file/metadata.json", "path to the database file")
+	databaseFilePath           = flag.String("database-file-path", "./test/fixtures/file/metadata.json", "path to the database file")
+	databaseFileReloadInterval = flag.Duration("database-file-reload-interval", time.Minute, "how often to check the database file for changes, reloading it when it has changed (0 to only reload on SIGHUP)")
+
+	// Database - SQLite
+	databaseSQLitePath = flag.String("database-sqlite-path", "./picsum.db", "path to the sqlite database, populated with database-import")
 
 	// HMAC
 	hmacKey = flag.String("hmac-key", "", "hmac key to use for authentication between services")
@@ -65,9 +75,31 @@ func main() {
 	defer shutdown()
 
 	// Initialize the database
-	database, err := fileDatabase.New(*databaseFilePath)
-	if err != nil {
-		log.Fatalf("error initializing database: %s", err)
+	var databaseProvider database.Provider
+	switch *databaseBackend {
+	case "file":
+		fileProvider, err := fileDatabase.New(*databaseFilePath)
+		if err != nil {
+			log.Fatalf("error initializing database: %s", err)
+		}
+
+		// Reload the database when it changes, or on SIGHUP
+		go reloadOnSignal(shutdownCtx, log, fileProvider)
+		if *databaseFileReloadInterval > 0 {
+			go fileProvider.Watch(shutdownCtx, log, *databaseFileReloadInterval)
+		}
+
+		databaseProvider = fileProvider
+	case "sqlite":
+		sqliteProvider, err := sqlite.New(*databaseSQLitePath)
+		if err != nil {
+			log.Fatalf("error initializing database: %s", err)
+		}
+		defer sqliteProvider.Close()
+
+		databaseProvider = sqliteProvider
+	default:
+		log.Fatalf("unknown database backend %s", *databaseBackend)
 	}
 
 	// Initialize and start the health checker
@@ -76,14 +108,14 @@ func main() {
 
 	checker := &health.Checker{
 		Ctx:      checkerCtx,
-		Database: database,
+		Database: databaseProvider,
 		Log:      log,
 	}
 	go checker.Run()
 
 	// Start and listen on http
 	api := &api.API{
-		Database:        database,
+		Database:        databaseProvider,
 		Log:             log,
 		Tracer:          tracer,
 		RootURL:         *rootURL,
@@ -130,7 +162,7 @@ func main() {
 	log.Infof("http server listening on %s", *listen)
 
 	// Start the metrics http server
-	go metrics.Serve(shutdownCtx, log, checker, *metricsListen)
+	go metrics.Serve(shutdownCtx, log, checker, nil, *metricsListen)
 
 	// Wait for shutdown
 	<-shutdownCtx.Done()
@@ -143,3 +175,25 @@ func main() {
 		log.Warnf("error shutting down: %s", err)
 	}
 }
+
+// reloadOnSignal reloads the database whenever the process receives a SIGHUP, until the context is done
+func reloadOnSignal(ctx context.Context, log *logger.Logger, provider *fileDatabase.Provider) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	defer signal.Stop(signals)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-signals:
+		}
+
+		if err := provider.Reload(); err != nil {
+			log.Errorw("error reloading database file, serving the previous one", "path", *databaseFilePath, "error", err)
+			continue
+		}
+
+		log.Infow("reloaded database file", "path", *databaseFilePath, "images", provider.Len())
+	}
+}
@@ -0,0 +1,170 @@
+package admin
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"net/http"
+	"strings"
+
+	"github.com/DMarby/picsum-photos/internal/handler"
+	"github.com/DMarby/picsum-photos/internal/logger"
+)
+
+var (
+	purgedEntries = expvar.NewMap("counter_labelmap_cache_admin_purged_entries")
+	purgedBytes   = expvar.NewMap("counter_labelmap_cache_admin_purged_bytes")
+)
+
+// Cache is a cache that can be purged
+// It's implemented by cache.Provider, Keys may return the keys of the parts of the cache that work along with an error, such as for cache.Tiered
+type Cache interface {
+	Keys(ctx context.Context) (keys []string, err error)
+	Delete(ctx context.Context, key string) (freed int64, err error)
+}
+
+// API is a http api for administrative tasks, authenticated with a bearer token
+type API struct {
+	Token  string
+	Log    *logger.Logger
+	Caches map[string]Cache // the caches to purge, by name
+}
+
+// Purged contains how much was purged from a cache
+type Purged struct {
+	Entries int    `json:"entries"`
+	Bytes   int64  `json:"bytes"`
+	Error   string `json:"error,omitempty"` // set if part of the cache couldn't be purged
+}
+
+// Router returns a http router
+func (a *API) Router() http.Handler {
+	router := http.NewServeMux()
+
+	// Query parameters, exactly one is required:
+	// ?id={id} - Purge everything for the image with the given ID
+	// ?prefix={prefix} - Purge the keys with the given prefix
+	// ?all - Purge everything
+	router.Handle("POST /admin/purge", handler.Handler(a.purgeHandler))
+
+	return a.authenticate(router)
+}
+
+// authenticate requires requests to have the token in the Authorization header
+func (a *API) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if a.Token == "" || !ok || subtle.ConstantTimeCompare([]byte(token), []byte(a.Token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (a *API) purgeHandler(w http.ResponseWriter, r *http.Request) *handler.Error {
+	query := r.URL.Query()
+
+	var (
+		match    func(key string) bool
+		criteria int
+	)
+
+	if query.Has("id") {
+		criteria++
+		id := query.Get("id")
+		if id == "" {
+			return handler.BadRequest("id must not be empty")
+		}
+
+		// Processed images are keyed by {id}-{width}x{height}..., and source images by {id} or {id}_{size}
+		match = func(key string) bool {
+			return key == id || strings.HasPrefix(key, id+"-") || strings.HasPrefix(key, id+"_")
+		}
+	}
+
+	if query.Has("prefix") {
+		criteria++
+		prefix := query.Get("prefix")
+		if prefix == "" {
+			return handler.BadRequest("prefix must not be empty, use all to purge everything")
+		}
+
+		match = func(key string) bool {
+			return strings.HasPrefix(key, prefix)
+		}
+	}
+
+	if query.Has("all") {
+		criteria++
+		match = func(key string) bool {
+			return true
+		}
+	}
+
+	if criteria != 1 {
+		return handler.BadRequest("exactly one of id, prefix or all is required")
+	}
+
+	// Purge as much as possible, a failing cache, or part of one, doesn't prevent purging the others
+	status := http.StatusOK
+	result := make(map[string]Purged, len(a.Caches))
+	for name, cache := range a.Caches {
+		purged, err := purge(r.Context(), cache, match)
+		purgedEntries.Add(name, int64(purged.Entries))
+		purgedBytes.Add(name, purged.Bytes)
+
+		if err != nil {
+			a.Log.Errorw("error purging cache", handler.LogFields(r, "cache", name, "error", err)...)
+			purged.Error = err.Error()
+			status = http.StatusInternalServerError
+		}
+
+		result[name] = purged
+	}
+
+	a.Log.Infow("purged caches", handler.LogFields(r, "query", r.URL.RawQuery, "purged", result)...)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "private, no-cache, no-store, must-revalidate")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(result); err != nil {
+		a.logError(r, "error encoding purge result", err)
+		return handler.InternalServerError()
+	}
+
+	return nil
+}
+
+// purge deletes the keys in the cache that match
+// It keeps going when parts of the cache fail, returning the first error of the listing and of the deletes
+func purge(ctx context.Context, cache Cache, match func(key string) bool) (Purged, error) {
+	var purged Purged
+
+	keys, keysErr := cache.Keys(ctx)
+
+	var deleteErr error
+	for _, key := range keys {
+		if !match(key) {
+			continue
+		}
+
+		freed, err := cache.Delete(ctx, key)
+		if err != nil && deleteErr == nil {
+			deleteErr = err
+		}
+
+		purged.Entries++
+		purged.Bytes += freed
+	}
+
+	return purged, errors.Join(keysErr, deleteErr)
+}
+
+func (a *API) logError(r *http.Request, message string, err error) {
+	a.Log.Errorw(message, handler.LogFields(r, "error", err)...)
+}
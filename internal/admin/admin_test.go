@@ -0,0 +1,195 @@
+package admin_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/DMarby/picsum-photos/internal/admin"
+	"github.com/DMarby/picsum-photos/internal/cache/memory"
+	"github.com/DMarby/picsum-photos/internal/logger"
+	"go.uber.org/zap"
+)
+
+// partialCache is a cache where part of it, such as a remote tier, is unavailable
+type partialCache struct {
+	*memory.Provider
+}
+
+var errUnavailable = errors.New("unavailable")
+
+func (c partialCache) Keys(ctx context.Context) ([]string, error) {
+	keys, _ := c.Provider.Keys(ctx)
+	return keys, errUnavailable
+}
+
+func TestPurge(t *testing.T) {
+	log := logger.New(zap.FatalLevel)
+	defer log.Sync()
+
+	ctx := context.Background()
+
+	setup := func() (http.Handler, *memory.Provider, *memory.Provider) {
+		processed := memory.New(1<<20, 0)
+		processed.Set(ctx, "1-200x300.jpg", []byte("aaaa"))
+		processed.Set(ctx, "1-200x300.webp-grayscale", []byte("bb"))
+		processed.Set(ctx, "10-200x300.jpg", []byte("cccc"))
+
+		source := memory.New(1<<20, 0)
+		source.Set(ctx, "1_500", []byte("dddddd"))
+		source.Set(ctx, "1", []byte("e"))
+		source.Set(ctx, "10_500", []byte("ffffff"))
+
+		router := (&admin.API{
+			Token: "secret",
+			Log:   log,
+			Caches: map[string]admin.Cache{
+				"processed": processed,
+				"source":    source,
+			},
+		}).Router()
+
+		return router, processed, source
+	}
+
+	purge := func(router http.Handler, query string, token string) *httptest.ResponseRecorder {
+		t.Helper()
+
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/admin/purge?"+query, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	keys := func(provider *memory.Provider) []string {
+		keys, _ := provider.Keys(ctx)
+		sort.Strings(keys)
+		return keys
+	}
+
+	t.Run("requires authentication", func(t *testing.T) {
+		router, processed, _ := setup()
+
+		for _, token := range []string{"", "wrong"} {
+			if w := purge(router, "all", token); w.Code != http.StatusUnauthorized {
+				t.Errorf("%#v: wrong response code, %#v", token, w.Code)
+			}
+		}
+
+		if len(keys(processed)) != 3 {
+			t.Errorf("cache was purged")
+		}
+	})
+
+	t.Run("validates the parameters", func(t *testing.T) {
+		router, _, _ := setup()
+
+		for _, query := range []string{"", "id=", "prefix=", "id=1&all"} {
+			if w := purge(router, query, "secret"); w.Code != http.StatusBadRequest {
+				t.Errorf("%#v: wrong response code, %#v", query, w.Code)
+			}
+		}
+	})
+
+	tests := []struct {
+		Name              string
+		Query             string
+		Expected          map[string]admin.Purged
+		ExpectedProcessed []string
+		ExpectedSource    []string
+	}{
+		{
+			"by id",
+			"id=1",
+			map[string]admin.Purged{"processed": {Entries: 2, Bytes: 6}, "source": {Entries: 2, Bytes: 7}},
+			[]string{"10-200x300.jpg"},
+			[]string{"10_500"},
+		},
+		{
+			"by prefix",
+			"prefix=1-",
+			map[string]admin.Purged{"processed": {Entries: 2, Bytes: 6}, "source": {}},
+			[]string{"10-200x300.jpg"},
+			[]string{"1", "10_500", "1_500"},
+		},
+		{
+			"all",
+			"all",
+			map[string]admin.Purged{"processed": {Entries: 3, Bytes: 10}, "source": {Entries: 3, Bytes: 13}},
+			[]string{},
+			[]string{},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			router, processed, source := setup()
+
+			w := purge(router, test.Query, "secret")
+			if w.Code != http.StatusOK {
+				t.Fatalf("wrong response code, %#v", w.Code)
+			}
+
+			var result map[string]admin.Purged
+			if err := json.NewDecoder(w.Body).Decode(&result); err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(result, test.Expected) {
+				t.Errorf("wrong result %#v", result)
+			}
+
+			if keys := keys(processed); !reflect.DeepEqual(keys, test.ExpectedProcessed) {
+				t.Errorf("wrong processed keys %#v", keys)
+			}
+
+			if keys := keys(source); !reflect.DeepEqual(keys, test.ExpectedSource) {
+				t.Errorf("wrong source keys %#v", keys)
+			}
+		})
+	}
+
+	t.Run("purges the rest when part of a cache fails", func(t *testing.T) {
+		processed := memory.New(1<<20, 0)
+		processed.Set(ctx, "1-200x300.jpg", []byte("aaaa"))
+
+		source := memory.New(1<<20, 0)
+		source.Set(ctx, "1_500", []byte("dddddd"))
+
+		router := (&admin.API{
+			Token: "secret",
+			Log:   log,
+			Caches: map[string]admin.Cache{
+				"processed": processed,
+				"source":    partialCache{source},
+			},
+		}).Router()
+
+		w := purge(router, "id=1", "secret")
+		if w.Code != http.StatusInternalServerError {
+			t.Errorf("wrong response code, %#v", w.Code)
+		}
+
+		var result map[string]admin.Purged
+		if err := json.NewDecoder(w.Body).Decode(&result); err != nil {
+			t.Fatal(err)
+		}
+
+		expected := map[string]admin.Purged{"processed": {Entries: 1, Bytes: 4}, "source": {Entries: 1, Bytes: 6, Error: "unavailable"}}
+		if !reflect.DeepEqual(result, expected) {
+			t.Errorf("wrong result %#v", result)
+		}
+
+		if len(keys(processed)) != 0 || len(keys(source)) != 0 {
+			t.Errorf("cache wasn't purged")
+		}
+	})
+}
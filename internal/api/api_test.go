@@ -189,6 +189,43 @@ func TestAPI(t *testing.T) {
 				"Access-Control-Expose-Headers": "Link",
 			},
 		},
+		{
+			Name:           "/v2/list filters and sorts images",
+			URL:            "/v2/list?author=john+doe&orientation=portrait&sort=id&order=desc&limit=1",
+			Router:         paginationRouter,
+			ExpectedStatus: http.StatusOK,
+			ExpectedResponse: marshalJson([]api.ListImage{
+				{
+					Image: database.Image{
+						ID:     "2",
+						Author: "John Doe",
+						URL:    "https://picsum.photos",
+						Width:  300,
+						Height: 400,
+					},
+					DownloadURL: fmt.Sprintf("%s/id/2/300/400", rootURL),
+				},
+			}),
+			ExpectedHeaders: map[string]string{
+				"Content-Type":                  "application/json",
+				"Link":                          fmt.Sprintf("<%s/v2/list?page=2&limit=1&author=john+doe&order=desc&orientation=portrait&sort=id>; rel=\"next\"", rootURL),
+				"Cache-Control":                 "private, no-cache, no-store, must-revalidate",
+				"Access-Control-Expose-Headers": "Link",
+			},
+		},
+		{
+			Name:             "/v2/list filters out all images",
+			URL:              "/v2/list?orientation=landscape",
+			Router:           paginationRouter,
+			ExpectedStatus:   http.StatusOK,
+			ExpectedResponse: marshalJson([]api.ListImage{}),
+			ExpectedHeaders: map[string]string{
+				"Content-Type":                  "application/json",
+				"Link":                          fmt.Sprintf("<%s/v2/list?page=2&limit=30&orientation=landscape>; rel=\"next\"", rootURL),
+				"Cache-Control":                 "private, no-cache, no-store, must-revalidate",
+				"Access-Control-Expose-Headers": "Link",
+			},
+		},
 		{
 			Name:           "Deprecated /list lists images",
 			URL:            "/list",
@@ -266,6 +303,11 @@ func TestAPI(t *testing.T) {
 		{"invalid size", "/9223372036854775808", router, http.StatusBadRequest, []byte("Invalid size\n"), map[string]string{"Content-Type": "text/plain; charset=utf-8", "Cache-Control": "private, no-cache, no-store, must-revalidate"}},          // Number larger then maxImageSize to fail int parsing
 		{"invalid blur amount", "/id/1/100/100?blur=11", router, http.StatusBadRequest, []byte("Invalid blur amount\n"), map[string]string{"Content-Type": "text/plain; charset=utf-8", "Cache-Control": "private, no-cache, no-store, must-revalidate"}},
 		{"invalid blur amount", "/id/1/100/100?blur=0", router, http.StatusBadRequest, []byte("Invalid blur amount\n"), map[string]string{"Content-Type": "text/plain; charset=utf-8", "Cache-Control": "private, no-cache, no-store, must-revalidate"}},
+		{"invalid orientation", "/v2/list?orientation=diagonal", paginationRouter, http.StatusBadRequest, []byte("Invalid orientation\n"), map[string]string{"Content-Type": "text/plain; charset=utf-8", "Cache-Control": "private, no-cache, no-store, must-revalidate"}},
+		{"invalid width", "/v2/list?min_width=0", paginationRouter, http.StatusBadRequest, []byte("Invalid min_width\n"), map[string]string{"Content-Type": "text/plain; charset=utf-8", "Cache-Control": "private, no-cache, no-store, must-revalidate"}},
+		{"invalid aspect ratio", "/v2/list?max_aspect_ratio=abc", paginationRouter, http.StatusBadRequest, []byte("Invalid max_aspect_ratio\n"), map[string]string{"Content-Type": "text/plain; charset=utf-8", "Cache-Control": "private, no-cache, no-store, must-revalidate"}},
+		{"invalid sort", "/v2/list?sort=size", paginationRouter, http.StatusBadRequest, []byte("Invalid sort\n"), map[string]string{"Content-Type": "text/plain; charset=utf-8", "Cache-Control": "private, no-cache, no-store, must-revalidate"}},
+		{"invalid order", "/v2/list?order=up", paginationRouter, http.StatusBadRequest, []byte("Invalid order\n"), map[string]string{"Content-Type": "text/plain; charset=utf-8", "Cache-Control": "private, no-cache, no-store, must-revalidate"}},
 		{"invalid file extension", "/id/1/100/100.png", router, http.StatusBadRequest, []byte("Invalid file extension\n"), map[string]string{"Content-Type": "text/plain; charset=utf-8", "Cache-Control": "private, no-cache, no-store, must-revalidate"}},
 		// Deprecated handler errors
 		{"invalid size", "/g/9223372036854775808", router, http.StatusBadRequest, []byte("Invalid size\n"), map[string]string{"Content-Type": "text/plain; charset=utf-8", "Cache-Control": "private, no-cache, no-store, must-revalidate"}}, // Number larger then max int size to fail int parsing
@@ -420,38 +462,43 @@ func TestAPI(t *testing.T) {
 	}
 
 	for _, test := range redirectTests {
-		w := httptest.NewRecorder()
-		req, _ := http.NewRequest("GET", test.URL, nil)
-		router.ServeHTTP(w, req)
-		if w.Code != http.StatusFound && w.Code != http.StatusMovedPermanently {
-			t.Errorf("%s: wrong response code, %#v", test.Name, w.Code)
-			continue
-		}
-
-		location := w.Header().Get("Location")
-
-		expectedURL := test.ExpectedURL
-		if !test.LocalRedirect {
-			expectedHMAC, err := hmac.Create(test.ExpectedURL)
-			if err != nil {
-				t.Errorf("%s: hmac error %s", test.Name, err)
+		// Redirects are also served for HEAD requests, for link checkers
+		for _, method := range []string{"GET", "HEAD"} {
+			name := fmt.Sprintf("%s %s", method, test.Name)
+
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest(method, test.URL, nil)
+			router.ServeHTTP(w, req)
+			if w.Code != http.StatusFound && w.Code != http.StatusMovedPermanently {
+				t.Errorf("%s: wrong response code, %#v", name, w.Code)
 				continue
 			}
 
-			if strings.Contains(test.ExpectedURL, "?") {
-				expectedURL = imageServiceURL + test.ExpectedURL + "&hmac=" + expectedHMAC
-			} else {
-				expectedURL = imageServiceURL + test.ExpectedURL + "?hmac=" + expectedHMAC
+			location := w.Header().Get("Location")
+
+			expectedURL := test.ExpectedURL
+			if !test.LocalRedirect {
+				expectedHMAC, err := hmac.Create(test.ExpectedURL)
+				if err != nil {
+					t.Errorf("%s: hmac error %s", name, err)
+					continue
+				}
+
+				if strings.Contains(test.ExpectedURL, "?") {
+					expectedURL = imageServiceURL + test.ExpectedURL + "&hmac=" + expectedHMAC
+				} else {
+					expectedURL = imageServiceURL + test.ExpectedURL + "?hmac=" + expectedHMAC
+				}
 			}
-		}
 
-		if location != expectedURL {
-			t.Errorf("%s: wrong redirect %s, expected %s", test.Name, location, expectedURL)
-		}
+			if location != expectedURL {
+				t.Errorf("%s: wrong redirect %s, expected %s", name, location, expectedURL)
+			}
 
-		if test.ExpectedCacheHeader != "" {
-			if cacheControl := w.Header().Get("Cache-Control"); cacheControl != test.ExpectedCacheHeader {
-				t.Errorf("%s: wrong cache header, got %#v, expected %#v", test.Name, cacheControl, test.ExpectedCacheHeader)
+			if test.ExpectedCacheHeader != "" {
+				if cacheControl := w.Header().Get("Cache-Control"); cacheControl != test.ExpectedCacheHeader {
+					t.Errorf("%s: wrong cache header, got %#v, expected %#v", name, cacheControl, test.ExpectedCacheHeader)
+				}
 			}
 		}
 	}
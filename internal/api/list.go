@@ -5,7 +5,9 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"math"
 	"net/http"
+	"net/url"
 	"strconv"
 
 	"github.com/DMarby/picsum-photos/internal/database"
@@ -76,13 +78,20 @@ func (a *API) infoSeedHandler(w http.ResponseWriter, r *http.Request) *handler.E
 }
 
 // Paginated list, with `page` and `limit` query parameters
+// The images can be filtered by `author`, `orientation`, `min_width`, `max_width`, `min_height`, `max_height`,
+// `min_aspect_ratio` and `max_aspect_ratio`, and sorted with `sort` and `order`
 func (a *API) listHandler(w http.ResponseWriter, r *http.Request) *handler.Error {
 	limit := getLimit(r)
 	page := getPage(r)
 
 	offset := limit * (page - 1)
 
-	databaseList, err := a.Database.List(r.Context(), offset, limit)
+	filter, sort, err := getListQuery(r)
+	if err != nil {
+		return handler.BadRequest(err.Error())
+	}
+
+	databaseList, err := a.Database.List(r.Context(), filter, sort, offset, limit)
 	if err != nil {
 		a.logError(r, "error getting image list from database", err)
 		return handler.InternalServerError()
@@ -100,7 +109,7 @@ func (a *API) listHandler(w http.ResponseWriter, r *http.Request) *handler.Error
 	// If we've ran out of items, don't include the next page in the Link header
 	end := len(list) < limit
 	w.Header().Set("Access-Control-Expose-Headers", "Link")
-	w.Header().Set("Link", a.getLinkHeader(page, limit, end))
+	w.Header().Set("Link", a.getLinkHeader(page, limit, end, listQuery(filter, sort)))
 
 	if err := json.NewEncoder(w).Encode(list); err != nil {
 		if !errors.Is(err, context.Canceled) {
@@ -134,19 +143,144 @@ func getPage(r *http.Request) int {
 	return page
 }
 
-func (a *API) getLinkHeader(page, limit int, end bool) string {
+// getListQuery returns the filter and sort from the query parameters
+func getListQuery(r *http.Request) (database.Filter, database.Sort, error) {
+	query := r.URL.Query()
+
+	filter := database.Filter{
+		Author:      query.Get("author"),
+		Orientation: database.Orientation(query.Get("orientation")),
+	}
+
+	switch filter.Orientation {
+	case "", database.OrientationLandscape, database.OrientationPortrait, database.OrientationSquare:
+	default:
+		return database.Filter{}, database.Sort{}, ErrInvalidOrientation
+	}
+
+	dimensions := []struct {
+		key   string
+		value *int
+	}{
+		{"min_width", &filter.MinWidth},
+		{"max_width", &filter.MaxWidth},
+		{"min_height", &filter.MinHeight},
+		{"max_height", &filter.MaxHeight},
+	}
+	for _, dimension := range dimensions {
+		if !query.Has(dimension.key) {
+			continue
+		}
+
+		value, err := strconv.Atoi(query.Get(dimension.key))
+		if err != nil || value < 1 {
+			return database.Filter{}, database.Sort{}, fmt.Errorf("Invalid %s", dimension.key)
+		}
+		*dimension.value = value
+	}
+
+	aspectRatios := []struct {
+		key   string
+		value *float64
+	}{
+		{"min_aspect_ratio", &filter.MinAspectRatio},
+		{"max_aspect_ratio", &filter.MaxAspectRatio},
+	}
+	for _, aspectRatio := range aspectRatios {
+		if !query.Has(aspectRatio.key) {
+			continue
+		}
+
+		value, err := strconv.ParseFloat(query.Get(aspectRatio.key), 64)
+		if err != nil || !(value > 0) || math.IsInf(value, 0) {
+			return database.Filter{}, database.Sort{}, fmt.Errorf("Invalid %s", aspectRatio.key)
+		}
+		*aspectRatio.value = value
+	}
+
+	sort := database.Sort{
+		Field: database.SortField(query.Get("sort")),
+	}
+
+	switch sort.Field {
+	case "", database.SortID, database.SortWidth, database.SortHeight, database.SortAuthor:
+	default:
+		return database.Filter{}, database.Sort{}, ErrInvalidSort
+	}
+
+	switch query.Get("order") {
+	case "", "asc":
+	case "desc":
+		sort.Descending = true
+	default:
+		return database.Filter{}, database.Sort{}, ErrInvalidOrder
+	}
+
+	return filter, sort, nil
+}
+
+// listQuery returns the query parameters for the filter and sort, so that the pagination links keep them
+func listQuery(filter database.Filter, sort database.Sort) url.Values {
+	query := url.Values{}
+
+	if filter.Author != "" {
+		query.Set("author", filter.Author)
+	}
+
+	if filter.Orientation != "" {
+		query.Set("orientation", string(filter.Orientation))
+	}
+
+	for key, value := range map[string]int{
+		"min_width":  filter.MinWidth,
+		"max_width":  filter.MaxWidth,
+		"min_height": filter.MinHeight,
+		"max_height": filter.MaxHeight,
+	} {
+		if value != 0 {
+			query.Set(key, strconv.Itoa(value))
+		}
+	}
+
+	for key, value := range map[string]float64{
+		"min_aspect_ratio": filter.MinAspectRatio,
+		"max_aspect_ratio": filter.MaxAspectRatio,
+	} {
+		if value != 0 {
+			query.Set(key, strconv.FormatFloat(value, 'f', -1, 64))
+		}
+	}
+
+	if sort.Field != "" {
+		query.Set("sort", string(sort.Field))
+	}
+
+	if sort.Descending {
+		query.Set("order", "desc")
+	}
+
+	return query
+}
+
+func (a *API) getLinkHeader(page, limit int, end bool, query url.Values) string {
+	link := func(page int) string {
+		if len(query) == 0 {
+			return fmt.Sprintf("%s/v2/list?page=%d&limit=%d", a.RootURL, page, limit)
+		}
+
+		return fmt.Sprintf("%s/v2/list?page=%d&limit=%d&%s", a.RootURL, page, limit, query.Encode())
+	}
+
 	// This will return a next even if there's only enough items for a single page, but lets ignore that for now
 	if page == 1 {
-		return fmt.Sprintf("<%s/v2/list?page=%d&limit=%d>; rel=\"next\"", a.RootURL, page+1, limit)
+		return fmt.Sprintf("<%s>; rel=\"next\"", link(page+1))
 	}
 
 	if end {
-		return fmt.Sprintf("<%s/v2/list?page=%d&limit=%d>; rel=\"prev\"", a.RootURL, page-1, limit)
+		return fmt.Sprintf("<%s>; rel=\"prev\"", link(page-1))
 	}
 
-	return fmt.Sprintf("<%s/v2/list?page=%d&limit=%d>; rel=\"prev\", <%s/v2/list?page=%d&limit=%d>; rel=\"next\"",
-		a.RootURL, page-1, limit, a.RootURL, page+1, limit,
-	)
+	return fmt.Sprintf("<%s>; rel=\"prev\", <%s>; rel=\"next\"", link(page-1), link(page+1))
 }
 
 func (a *API) getListImage(image database.Image) ListImage {
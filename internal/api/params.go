@@ -9,7 +9,10 @@ import (
 
 // Errors
 var (
-	ErrInvalidBlurAmount = fmt.Errorf("Invalid blur amount")
+	ErrInvalidBlurAmount  = fmt.Errorf("Invalid blur amount")
+	ErrInvalidOrientation = fmt.Errorf("Invalid orientation")
+	ErrInvalidSort        = fmt.Errorf("Invalid sort")
+	ErrInvalidOrder       = fmt.Errorf("Invalid order")
 )
 
 const (
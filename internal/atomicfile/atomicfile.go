@@ -0,0 +1,65 @@
+package atomicfile
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// TempPrefix is the prefix of the temporary files written before they're renamed into place
+// Files with it that are left behind by a crash can be removed
+const TempPrefix = ".tmp-"
+
+// Write writes the file at path using write, so that readers never see a partially written file
+// The data goes to a temporary file in the same directory, which is synced and renamed over path,
+// so that after a crash or power loss the file is either the previous one or the new one
+func Write(path string, perm os.FileMode, write func(w io.Writer) error) error {
+	dir := filepath.Dir(path)
+
+	file, err := os.CreateTemp(dir, TempPrefix+"*")
+	if err != nil {
+		return err
+	}
+
+	err = write(file)
+	if err == nil {
+		err = file.Chmod(perm)
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err == nil {
+		err = os.Rename(file.Name(), path)
+	}
+
+	if err != nil {
+		os.Remove(file.Name())
+		return err
+	}
+
+	// Sync the directory, so that the rename survives a power loss too
+	return syncDir(dir)
+}
+
+// WriteFile writes the data to the file at path, see Write
+func WriteFile(path string, data []byte, perm os.FileMode) error {
+	return Write(path, perm, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+}
+
+// syncDir flushes the directory entries of the directory at path to disk
+func syncDir(path string) error {
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+
+	return dir.Sync()
+}
@@ -0,0 +1,56 @@
+package atomicfile_test
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/DMarby/picsum-photos/internal/atomicfile"
+)
+
+func TestWrite(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "file")
+
+	if err := atomicfile.WriteFile(path, []byte("first"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if info.Mode().Perm() != 0644 {
+		t.Errorf("wrong permissions %s", info.Mode())
+	}
+
+	// A failed write keeps the previous file, and doesn't leave the temporary file behind
+	err = atomicfile.Write(path, 0644, func(w io.Writer) error {
+		w.Write([]byte("partial"))
+		return errors.New("write failed")
+	})
+	if err == nil {
+		t.Fatal("no error")
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(data) != "first" {
+		t.Errorf("wrong data %s", data)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(entries) != 1 {
+		t.Errorf("temporary file was left behind, %d files", len(entries))
+	}
+}
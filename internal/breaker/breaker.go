@@ -0,0 +1,88 @@
+package breaker
+
+import (
+	"sync"
+	"time"
+)
+
+// Breaker is a circuit breaker, that opens after Threshold consecutive failures
+// Once the Cooldown has passed, a single request is let through to probe the service,
+// closing the breaker if it succeeds and opening it for another cooldown if it fails
+//
+// Results are reported for the generation returned by Allow, the generation changes whenever the breaker opens or closes
+// Results of requests that were sent before that are ignored, as they say nothing about the service's current state
+type Breaker struct {
+	Threshold int
+	Cooldown  time.Duration
+
+	mutex      sync.Mutex
+	generation uint64
+	failures   int
+	openUntil  time.Time
+	probing    bool
+}
+
+// Allow returns whether a request may be sent, and the generation to report its result for
+func (b *Breaker) Allow() (uint64, bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.failures < b.Threshold {
+		return b.generation, true
+	}
+
+	if b.probing || time.Now().Before(b.openUntil) {
+		return 0, false
+	}
+
+	b.probing = true
+	return b.generation, true
+}
+
+// Success records a successful request, closing the breaker
+func (b *Breaker) Success(generation uint64) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if generation != b.generation {
+		return
+	}
+
+	if b.failures >= b.Threshold {
+		b.generation++
+	}
+
+	b.failures = 0
+	b.probing = false
+}
+
+// Failure records a failed request, returning whether it opened the breaker
+func (b *Breaker) Failure(generation uint64) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if generation != b.generation {
+		return false
+	}
+
+	b.probing = false
+	b.failures++
+
+	if b.failures < b.Threshold {
+		return false
+	}
+
+	b.generation++
+	b.openUntil = time.Now().Add(b.Cooldown)
+	return true
+}
+
+// Release records a request that neither succeeded nor failed, such as a cancelled one
+func (b *Breaker) Release(generation uint64) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if generation == b.generation {
+		b.probing = false
+	}
+}
@@ -0,0 +1,52 @@
+package breaker
+
+import (
+	"testing"
+	"time"
+)
+
+func TestGenerations(t *testing.T) {
+	b := &Breaker{Threshold: 2, Cooldown: time.Hour}
+
+	// A request that's still in flight when the breaker opens
+	stale, _ := b.Allow()
+
+	for i := 0; i < 2; i++ {
+		generation, _ := b.Allow()
+		b.Failure(generation)
+	}
+
+	if _, ok := b.Allow(); ok {
+		t.Fatal("breaker didn't open")
+	}
+
+	// Its result predates the breaker opening, so it doesn't close it
+	b.Success(stale)
+	if _, ok := b.Allow(); ok {
+		t.Error("breaker was closed by a request sent before it opened")
+	}
+
+	// Once the cooldown has passed, only the probe's result counts
+	b.openUntil = time.Now()
+	probe, ok := b.Allow()
+	if !ok {
+		t.Fatal("no probe was let through")
+	}
+
+	b.Release(stale)
+	if _, ok := b.Allow(); ok {
+		t.Error("a second probe was let through")
+	}
+
+	b.Success(probe)
+	if _, ok := b.Allow(); !ok {
+		t.Error("breaker didn't close")
+	}
+
+	// Failures of requests sent before it closed don't count towards opening it again
+	b.Failure(probe)
+	b.Failure(probe)
+	if _, ok := b.Allow(); !ok {
+		t.Error("breaker was opened by requests sent before it closed")
+	}
+}
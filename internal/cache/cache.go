@@ -3,15 +3,36 @@ package cache
 import (
 	"context"
 	"errors"
+	"expvar"
+	"sync"
+	"time"
 
+	"github.com/DMarby/picsum-photos/internal/storage"
 	"github.com/DMarby/picsum-photos/internal/tracing"
+	"go.opentelemetry.io/otel/attribute"
 	"golang.org/x/sync/singleflight"
 )
 
+const (
+	// Upper bound on the number of keys remembered as not found, so that requests for many missing keys can't use up memory
+	maxNegativeEntries = 10000
+	// How long a background refresh of a stale object may take
+	refreshTimeout = 30 * time.Second
+)
+
+var (
+	negativeHits  = expvar.NewInt("counter_cache_negative_hits")
+	staleHits     = expvar.NewInt("counter_cache_stale_hits")
+	refreshes     = expvar.NewInt("counter_cache_refreshes")
+	refreshErrors = expvar.NewInt("counter_cache_refresh_errors")
+)
+
 // Provider is an interface for getting and setting cached objects
 type Provider interface {
 	Get(ctx context.Context, key string) (data []byte, err error)
 	Set(ctx context.Context, key string, data []byte) (err error)
+	Keys(ctx context.Context) (keys []string, err error)
+	Delete(ctx context.Context, key string) (freed int64, err error) // returns the amount of bytes freed, deleting a key that doesn't exist isn't an error
 	Shutdown()
 }
 
@@ -23,7 +44,19 @@ type Auto struct {
 	Tracer      *tracing.Tracer
 	Provider    Provider
 	Loader      LoaderFunc
+	NegativeTTL time.Duration // how long to remember keys that the loader returned storage.ErrNotFound for, zero disables it
+	MaxAge      time.Duration // how long objects are fresh for, after which they're served stale while being reloaded in the background, zero disables it
 	lookupGroup singleflight.Group
+	refreshing  sync.Map // map[string]bool - keys being refreshed in the background
+
+	negativeMutex sync.Mutex
+	negative      map[string]negativeEntry
+}
+
+// negativeEntry is a key that the loader couldn't find
+type negativeEntry struct {
+	err     error
+	expires time.Time
 }
 
 // Get returns an object from the cache if it exists, otherwise it loads it into the cache and returns it
@@ -32,37 +65,188 @@ func (a *Auto) Get(ctx context.Context, key string) (data []byte, err error) {
 	defer span.End()
 
 	// Attempt to get the data from the cache
-	data, err = a.Provider.Get(ctx, key)
-	// Exit early if the error is nil as we got data from the cache
-	// Or if there's an error indicating that something went wrong
+	entry, err := a.Provider.Get(ctx, key)
+	if err == nil {
+		data, loaded := decodeEntry(entry)
+
+		// Serve stale data right away, and reload it in the background
+		if a.MaxAge > 0 && time.Since(loaded) > a.MaxAge {
+			staleHits.Add(1)
+			span.SetAttributes(attribute.String("cache.result", "stale"))
+			a.refresh(ctx, key)
+			return data, nil
+		}
+
+		span.SetAttributes(attribute.String("cache.result", "fresh"))
+		return data, nil
+	}
+
+	// Exit early if there's an error indicating that something went wrong
 	if err != ErrNotFound {
 		return
 	}
 
+	// Don't ask the loader again for keys it recently couldn't find
+	if err := a.getNegative(key); err != nil {
+		negativeHits.Add(1)
+		span.SetAttributes(attribute.String("cache.result", "negative"))
+		return nil, err
+	}
+
+	span.SetAttributes(attribute.String("cache.result", "miss"))
+
 	// Use singleflight to avoid concurrent requests
 	var v interface{}
 	v, err, _ = a.lookupGroup.Do(key, func() (interface{}, error) {
-		// Get the data
-		data, err := a.Loader(ctx, key)
-		if err != nil {
-			return nil, err
+		return a.load(ctx, key)
+	})
+
+	if err != nil {
+		return
+	}
+
+	data, _ = v.([]byte)
+	return
+}
+
+// load gets the data using the loader, and stores it in the cache
+func (a *Auto) load(ctx context.Context, key string) ([]byte, error) {
+	data, err := a.Loader(ctx, key)
+	if err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			a.setNegative(key, err)
 		}
 
-		// Store the data in the cache
-		err = a.Provider.Set(ctx, key, data)
+		return nil, err
+	}
+
+	// Store the data in the cache
+	err = a.Provider.Set(ctx, key, encodeEntry(data, time.Now()))
+	if err != nil {
+		return nil, err
+	}
+
+	return data, nil
+}
+
+// refresh reloads an object in the background, unless it's already being reloaded
+// If the loading fails, the stale object keeps being served until the next attempt
+func (a *Auto) refresh(ctx context.Context, key string) {
+	if _, loaded := a.refreshing.LoadOrStore(key, true); loaded {
+		return
+	}
+
+	refreshes.Add(1)
+
+	go func() {
+		defer a.refreshing.Delete(key)
+
+		// The refresh outlives the request that triggered it
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), refreshTimeout)
+		defer cancel()
+
+		ctx, span := a.Tracer.Start(ctx, "cache.Auto.refresh")
+		defer span.End()
+
+		_, err, _ := a.lookupGroup.Do(key, func() (interface{}, error) {
+			return a.load(ctx, key)
+		})
+
 		if err != nil {
-			return nil, err
-		}
+			refreshErrors.Add(1)
+			span.RecordError(err)
 
-		return data, nil
-	})
+			// The object no longer exists, stop serving it
+			if errors.Is(err, storage.ErrNotFound) {
+				a.Provider.Delete(ctx, key)
+			}
+		}
+	}()
+}
 
+// Keys returns the keys of the objects in the cache, along with the keys recently not found by the loader
+// This way purging a key with Keys and Delete also forgets that it wasn't found
+func (a *Auto) Keys(ctx context.Context) (keys []string, err error) {
+	keys, err = a.Provider.Keys(ctx)
 	if err != nil {
+		return nil, err
+	}
+
+	a.negativeMutex.Lock()
+	defer a.negativeMutex.Unlock()
+
+	if len(a.negative) == 0 {
+		return keys, nil
+	}
+
+	seen := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		seen[key] = true
+	}
+
+	for key := range a.negative {
+		if !seen[key] {
+			keys = append(keys, key)
+		}
+	}
+
+	return keys, nil
+}
+
+// Delete removes an object from the cache, and forgets if it was recently not found
+func (a *Auto) Delete(ctx context.Context, key string) (freed int64, err error) {
+	a.negativeMutex.Lock()
+	delete(a.negative, key)
+	a.negativeMutex.Unlock()
+
+	return a.Provider.Delete(ctx, key)
+}
+
+// getNegative returns the loader's error if the key was recently not found
+func (a *Auto) getNegative(key string) error {
+	a.negativeMutex.Lock()
+	defer a.negativeMutex.Unlock()
+
+	entry, ok := a.negative[key]
+	if !ok {
+		return nil
+	}
+
+	if time.Now().After(entry.expires) {
+		delete(a.negative, key)
+		return nil
+	}
+
+	return entry.err
+}
+
+// setNegative remembers that the key was not found
+func (a *Auto) setNegative(key string, err error) {
+	if a.NegativeTTL <= 0 {
 		return
 	}
 
-	data, _ = v.([]byte)
-	return
+	a.negativeMutex.Lock()
+	defer a.negativeMutex.Unlock()
+
+	if a.negative == nil {
+		a.negative = make(map[string]negativeEntry)
+	}
+
+	now := time.Now()
+	if len(a.negative) >= maxNegativeEntries {
+		for key, entry := range a.negative {
+			if now.After(entry.expires) {
+				delete(a.negative, key)
+			}
+		}
+
+		if len(a.negative) >= maxNegativeEntries {
+			return
+		}
+	}
+
+	a.negative[key] = negativeEntry{err: err, expires: now.Add(a.NegativeTTL)}
 }
 
 // Errors
@@ -2,12 +2,17 @@ package cache_test
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/DMarby/picsum-photos/internal/cache"
+	"github.com/DMarby/picsum-photos/internal/cache/memory"
 	"github.com/DMarby/picsum-photos/internal/cache/mock"
 	"github.com/DMarby/picsum-photos/internal/logger"
+	"github.com/DMarby/picsum-photos/internal/storage"
 	"github.com/DMarby/picsum-photos/internal/tracing/test"
 	"go.uber.org/zap"
 )
@@ -64,3 +69,144 @@ func TestAuto(t *testing.T) {
 	}
 
 }
+
+func TestNegative(t *testing.T) {
+	ctx := context.Background()
+
+	log := logger.New(zap.ErrorLevel)
+	defer log.Sync()
+
+	loads := 0
+	auto := &cache.Auto{
+		Tracer:   test.Tracer(log),
+		Provider: memory.New(1<<20, 0),
+		Loader: func(ctx context.Context, key string) ([]byte, error) {
+			loads++
+			if key == "error" {
+				return nil, errors.New("error")
+			}
+
+			return nil, storage.ErrNotFound
+		},
+		NegativeTTL: time.Minute,
+	}
+
+	for i := 0; i < 3; i++ {
+		if _, err := auto.Get(ctx, "notfound"); !errors.Is(err, storage.ErrNotFound) {
+			t.Fatalf("wrong error %v", err)
+		}
+	}
+
+	if loads != 1 {
+		t.Errorf("missing key was loaded %d times", loads)
+	}
+
+	// Other errors aren't remembered
+	for i := 0; i < 3; i++ {
+		auto.Get(ctx, "error")
+	}
+
+	if loads != 4 {
+		t.Errorf("failing key was loaded %d times", loads-1)
+	}
+
+	// Purging a key forgets that it wasn't found
+	keys, err := auto.Keys(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(keys) != 1 || keys[0] != "notfound" {
+		t.Fatalf("wrong keys %#v", keys)
+	}
+
+	if _, err := auto.Delete(ctx, "notfound"); err != nil {
+		t.Fatal(err)
+	}
+
+	auto.Get(ctx, "notfound")
+	if loads != 5 {
+		t.Errorf("purged key wasn't loaded again")
+	}
+}
+
+func TestStale(t *testing.T) {
+	ctx := context.Background()
+
+	log := logger.New(zap.ErrorLevel)
+	defer log.Sync()
+
+	var (
+		loads   atomic.Int64
+		failing atomic.Bool
+	)
+
+	provider := memory.New(1<<20, 0)
+	auto := &cache.Auto{
+		Tracer:   test.Tracer(log),
+		Provider: provider,
+		Loader: func(ctx context.Context, key string) ([]byte, error) {
+			n := loads.Add(1)
+			if failing.Load() {
+				return nil, errors.New("error")
+			}
+
+			return []byte(fmt.Sprintf("%s-%d", key, n)), nil
+		},
+		MaxAge: 50 * time.Millisecond,
+	}
+
+	get := func(expected string) {
+		t.Helper()
+
+		data, err := auto.Get(ctx, "foo")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(data) != expected {
+			t.Fatalf("wrong data %s, expected %s", data, expected)
+		}
+	}
+
+	waitForLoads := func(n int64) {
+		t.Helper()
+
+		deadline := time.Now().Add(5 * time.Second)
+		for loads.Load() < n {
+			if time.Now().After(deadline) {
+				t.Fatal("timed out waiting for the refresh")
+			}
+			time.Sleep(time.Millisecond)
+		}
+
+		// Give the refresh a moment to store the data
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	get("foo-1")
+	get("foo-1")
+
+	// Stale data is served while it's refreshed in the background
+	time.Sleep(60 * time.Millisecond)
+	get("foo-1")
+	waitForLoads(2)
+	get("foo-2")
+
+	// Stale data keeps being served when the refresh fails
+	failing.Store(true)
+	time.Sleep(60 * time.Millisecond)
+	get("foo-2")
+	waitForLoads(3)
+
+	if _, err := provider.Get(ctx, "foo"); err != nil {
+		t.Fatalf("stale data was removed, %s", err)
+	}
+
+	// Data stored by something else has an unknown age, and is refreshed
+	failing.Store(false)
+	provider.Set(ctx, "foo", []byte("raw"))
+	get("raw")
+	waitForLoads(4)
+	get("foo-4")
+}
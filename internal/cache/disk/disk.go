@@ -0,0 +1,283 @@
+package disk
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/DMarby/picsum-photos/internal/atomicfile"
+	"github.com/DMarby/picsum-photos/internal/cache"
+)
+
+// Extension of cache entry files, anything else in the directory is ignored, apart from leftover temporary files which are removed
+const entryExtension = ".cache"
+
+// Metrics are labelled by the name of the cache, as there can be several disk caches, such as for source and processed images
+var (
+	evictions   = expvar.NewMap("counter_labelmap_cache_disk_cache_evictions")
+	sizeGauges  = expvar.NewMap("gauge_labelmap_cache_disk_cache_size")
+	bytesGauges = expvar.NewMap("gauge_labelmap_cache_disk_cache_bytes")
+)
+
+// Provider implements a disk-backed LRU cache bounded by the total size of the cached files
+// The recency of each entry is stored as the modification time of its file, so that the LRU order survives restarts
+type Provider struct {
+	name     string
+	path     string
+	maxBytes int64
+
+	mutex   sync.Mutex
+	entries map[string]*list.Element
+	order   *list.List // front is the most recently used
+	bytes   int64
+}
+
+type entry struct {
+	key  string
+	size int64
+}
+
+// New returns a new Provider instance storing up to maxBytes of data in the directory at path, with its metrics labelled by name
+// The index of the cache is rebuilt from the files already in the directory
+func New(name string, path string, maxBytes int64) (*Provider, error) {
+	if err := os.MkdirAll(path, 0755); err != nil {
+		return nil, err
+	}
+
+	p := &Provider{
+		name:     name,
+		path:     path,
+		maxBytes: maxBytes,
+		entries:  make(map[string]*list.Element),
+		order:    list.New(),
+	}
+
+	if err := p.rebuildIndex(); err != nil {
+		return nil, fmt.Errorf("error rebuilding disk cache index: %w", err)
+	}
+
+	sizeGauges.Set(name, expvar.Func(func() any {
+		return p.Len()
+	}))
+	bytesGauges.Set(name, expvar.Func(func() any {
+		return p.Size()
+	}))
+
+	return p, nil
+}
+
+// rebuildIndex scans the cache directory, ordering the entries by their modification time
+func (p *Provider) rebuildIndex() error {
+	dirEntries, err := os.ReadDir(p.path)
+	if err != nil {
+		return err
+	}
+
+	type file struct {
+		key     string
+		size    int64
+		modTime time.Time
+	}
+
+	var files []file
+	for _, dirEntry := range dirEntries {
+		name := dirEntry.Name()
+		if dirEntry.IsDir() {
+			continue
+		}
+
+		// Remove writes that were interrupted by a crash or restart
+		if strings.HasPrefix(name, atomicfile.TempPrefix) {
+			os.Remove(filepath.Join(p.path, name))
+			continue
+		}
+
+		escapedKey, ok := strings.CutSuffix(name, entryExtension)
+		if !ok {
+			continue
+		}
+
+		key, err := url.PathUnescape(escapedKey)
+		if err != nil {
+			continue
+		}
+
+		info, err := dirEntry.Info()
+		if err != nil {
+			continue
+		}
+
+		files = append(files, file{key: key, size: info.Size(), modTime: info.ModTime()})
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].modTime.After(files[j].modTime)
+	})
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	for _, f := range files {
+		p.entries[f.key] = p.order.PushBack(&entry{key: f.key, size: f.size})
+		p.bytes += f.size
+	}
+
+	// The budget may have been lowered since the last run
+	p.evict()
+
+	return nil
+}
+
+func (p *Provider) filename(key string) string {
+	return filepath.Join(p.path, url.PathEscape(key)+entryExtension)
+}
+
+// Get returns an object from the cache if it exists
+func (p *Provider) Get(ctx context.Context, key string) (data []byte, err error) {
+	p.mutex.Lock()
+	element, ok := p.entries[key]
+	if ok {
+		p.order.MoveToFront(element)
+	}
+	p.mutex.Unlock()
+
+	if !ok {
+		return nil, cache.ErrNotFound
+	}
+
+	filename := p.filename(key)
+	data, err = os.ReadFile(filename)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			// The file has been removed from under us, forget about it
+			p.remove(key)
+			return nil, cache.ErrNotFound
+		}
+
+		return nil, err
+	}
+
+	// Persist the recency of the entry, so that the LRU order survives restarts
+	now := time.Now()
+	os.Chtimes(filename, now, now)
+
+	return data, nil
+}
+
+// Set adds an object to the cache, evicting the least recently used objects if needed
+func (p *Provider) Set(ctx context.Context, key string, data []byte) (err error) {
+	size := int64(len(data))
+	if size > p.maxBytes {
+		return nil
+	}
+
+	// Readers never see partially written files, and a crash can't leave a truncated entry that the index trusts after a restart
+	if err := atomicfile.WriteFile(p.filename(key), data, 0600); err != nil {
+		return err
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if element, ok := p.entries[key]; ok {
+		p.bytes -= element.Value.(*entry).size
+		p.order.Remove(element)
+	}
+
+	p.entries[key] = p.order.PushFront(&entry{key: key, size: size})
+	p.bytes += size
+	p.evict()
+
+	return nil
+}
+
+// Keys returns the keys of all the objects in the cache, from the most to the least recently used
+func (p *Provider) Keys(ctx context.Context) (keys []string, err error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	keys = make([]string, 0, len(p.entries))
+	for element := p.order.Front(); element != nil; element = element.Next() {
+		keys = append(keys, element.Value.(*entry).key)
+	}
+
+	return keys, nil
+}
+
+// Delete removes an object from the cache
+func (p *Provider) Delete(ctx context.Context, key string) (freed int64, err error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	element, ok := p.entries[key]
+	if !ok {
+		return 0, nil
+	}
+
+	if err := os.Remove(p.filename(key)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return 0, err
+	}
+
+	size := element.Value.(*entry).size
+	p.order.Remove(element)
+	delete(p.entries, key)
+	p.bytes -= size
+
+	return size, nil
+}
+
+// evict removes the least recently used entries until the cache is within its budget
+// Callers must hold the mutex
+func (p *Provider) evict() {
+	for p.bytes > p.maxBytes {
+		element := p.order.Back()
+		e := element.Value.(*entry)
+
+		p.order.Remove(element)
+		delete(p.entries, e.key)
+		p.bytes -= e.size
+		evictions.Add(p.name, 1)
+
+		os.Remove(p.filename(e.key))
+	}
+}
+
+// remove removes an entry from the index
+func (p *Provider) remove(key string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if element, ok := p.entries[key]; ok {
+		p.bytes -= element.Value.(*entry).size
+		p.order.Remove(element)
+		delete(p.entries, key)
+	}
+}
+
+// Size returns the total size in bytes of the cached objects
+func (p *Provider) Size() int64 {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	return p.bytes
+}
+
+// Len returns the number of cached objects
+func (p *Provider) Len() int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	return len(p.entries)
+}
+
+// Shutdown shuts down the cache
+func (p *Provider) Shutdown() {}
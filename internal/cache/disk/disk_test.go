@@ -0,0 +1,197 @@
+package disk_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/DMarby/picsum-photos/internal/cache"
+	"github.com/DMarby/picsum-photos/internal/cache/disk"
+)
+
+func TestDisk(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	provider, err := disk.New("test", t.TempDir(), 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("get item", func(t *testing.T) {
+		// Add item to the cache
+		if err := provider.Set(ctx, "foo/bar", []byte("bar")); err != nil {
+			t.Fatal(err)
+		}
+
+		// Get item from the cache
+		data, err := provider.Get(ctx, "foo/bar")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(data) != "bar" {
+			t.Fatal("wrong data")
+		}
+	})
+
+	t.Run("get nonexistant item", func(t *testing.T) {
+		_, err := provider.Get(ctx, "notfound")
+		if err == nil {
+			t.Fatal("no error")
+		}
+
+		if err != cache.ErrNotFound {
+			t.Fatalf("wrong error %s", err)
+		}
+	})
+}
+
+func TestDelete(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	provider, err := disk.New("test", dir, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	provider.Set(ctx, "a", []byte("aaaa"))
+	provider.Set(ctx, "b", []byte("bb"))
+
+	keys, err := provider.Keys(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(keys) != 2 || keys[0] != "b" || keys[1] != "a" {
+		t.Fatalf("wrong keys %#v", keys)
+	}
+
+	freed, err := provider.Delete(ctx, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if freed != 4 || provider.Size() != 2 {
+		t.Errorf("wrong amount freed %d, size %d", freed, provider.Size())
+	}
+
+	if _, err := provider.Get(ctx, "a"); err != cache.ErrNotFound {
+		t.Errorf("item wasn't deleted")
+	}
+
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 1 {
+		t.Errorf("file wasn't removed, %d files", len(entries))
+	}
+}
+
+func TestEviction(t *testing.T) {
+	ctx := context.Background()
+
+	provider, err := disk.New("test", t.TempDir(), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	provider.Set(ctx, "a", []byte("aaaa"))
+	provider.Set(ctx, "b", []byte("bbbb"))
+	provider.Get(ctx, "a")
+	provider.Set(ctx, "c", []byte("cccc"))
+
+	if _, err := provider.Get(ctx, "b"); err != cache.ErrNotFound {
+		t.Errorf("least recently used item wasn't evicted, %v", err)
+	}
+
+	for _, key := range []string{"a", "c"} {
+		if _, err := provider.Get(ctx, key); err != nil {
+			t.Errorf("%s: %s", key, err)
+		}
+	}
+
+	if size := provider.Size(); size != 8 {
+		t.Errorf("wrong size %d", size)
+	}
+}
+
+func TestRestart(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	provider, err := disk.New("test", dir, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	provider.Set(ctx, "a", []byte("aaaa"))
+	provider.Set(ctx, "b", []byte("bbbb"))
+
+	// Make a the most recently used item, the recency is stored with a granularity that depends on the filesystem
+	time.Sleep(10 * time.Millisecond)
+	provider.Get(ctx, "a")
+
+	// Leftovers from an interrupted write
+	tempFile := filepath.Join(dir, ".tmp-123")
+	if err := os.WriteFile(tempFile, []byte("partial"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	provider, err = disk.New("test", dir, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if provider.Len() != 2 || provider.Size() != 8 {
+		t.Fatalf("wrong index after restart, %d items, %d bytes", provider.Len(), provider.Size())
+	}
+
+	if _, err := os.Stat(tempFile); !os.IsNotExist(err) {
+		t.Errorf("temporary file wasn't removed")
+	}
+
+	provider.Set(ctx, "c", []byte("cccc"))
+
+	if _, err := provider.Get(ctx, "b"); err != cache.ErrNotFound {
+		t.Errorf("least recently used item wasn't evicted, %v", err)
+	}
+
+	data, err := provider.Get(ctx, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(data) != "aaaa" {
+		t.Errorf("wrong data %s", data)
+	}
+}
+
+func TestShrink(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	provider, err := disk.New("test", dir, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	provider.Set(ctx, "a", []byte("aaaa"))
+	provider.Set(ctx, "b", []byte("bbbb"))
+
+	// Restart with a smaller budget
+	provider, err = disk.New("test", dir, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if provider.Len() != 1 || provider.Size() != 4 {
+		t.Fatalf("cache wasn't shrunk, %d items, %d bytes", provider.Len(), provider.Size())
+	}
+
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 1 {
+		t.Errorf("evicted files weren't removed, %d files", len(entries))
+	}
+}
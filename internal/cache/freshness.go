@@ -0,0 +1,33 @@
+package cache
+
+import (
+	"bytes"
+	"encoding/binary"
+	"time"
+)
+
+// Stored objects are prefixed with a header containing when they were loaded, so that their freshness is known wherever they're cached
+// Objects without the header were stored by something else, and are treated as having been loaded at an unknown time
+var headerMagic = []byte("\x00picsum\x00")
+
+const headerLength = 16 // magic + unix nanoseconds
+
+// encodeEntry prefixes the data with the time it was loaded
+func encodeEntry(data []byte, loaded time.Time) []byte {
+	entry := make([]byte, headerLength+len(data))
+	copy(entry, headerMagic)
+	binary.BigEndian.PutUint64(entry[len(headerMagic):headerLength], uint64(loaded.UnixNano()))
+	copy(entry[headerLength:], data)
+
+	return entry
+}
+
+// decodeEntry returns the data and the time it was loaded, which is zero if unknown
+func decodeEntry(entry []byte) ([]byte, time.Time) {
+	if len(entry) < headerLength || !bytes.HasPrefix(entry, headerMagic) {
+		return entry, time.Time{}
+	}
+
+	loaded := time.Unix(0, int64(binary.BigEndian.Uint64(entry[len(headerMagic):headerLength])))
+	return entry[headerLength:], loaded
+}
@@ -2,30 +2,50 @@ package memory
 
 import (
 	"context"
-	"sync"
+	"expvar"
+	"time"
 
 	"github.com/DMarby/picsum-photos/internal/cache"
+	"github.com/DMarby/picsum-photos/internal/lru"
 )
 
-// Provider implements a simple in-memory cache
+// Provider implements an in-memory LRU cache, bounded by the total size of the cached objects
 type Provider struct {
-	cache map[string][]byte
-	mutex sync.RWMutex
+	cache *lru.Cache
 }
 
-// New returns a new Provider instance
-func New() *Provider {
-	return &Provider{
-		cache: make(map[string][]byte),
+// New returns a new Provider instance that holds up to maxBytes of data, with objects expiring after ttl
+// A ttl of zero means that objects don't expire
+func New(maxBytes int64, ttl time.Duration) *Provider {
+	p := &Provider{
+		cache: lru.New(maxBytes, ttl, nil),
 	}
+
+	// Publish cache metrics (only if not already registered)
+	if expvar.Get("gauge_cache_memory_size") == nil {
+		expvar.Publish("gauge_cache_memory_size", expvar.Func(func() any {
+			return p.cache.Len()
+		}))
+		expvar.Publish("gauge_cache_memory_bytes", expvar.Func(func() any {
+			return p.cache.Stats().Bytes
+		}))
+		expvar.Publish("counter_cache_memory_evictions", expvar.Func(func() any {
+			return p.cache.Stats().Evictions
+		}))
+		expvar.Publish("counter_cache_memory_expirations", expvar.Func(func() any {
+			return p.cache.Stats().Expirations
+		}))
+		expvar.Publish("gauge_cache_memory_hit_ratio", expvar.Func(func() any {
+			return p.cache.Stats().HitRatio()
+		}))
+	}
+
+	return p
 }
 
 // Get returns an object from the cache if it exists
 func (p *Provider) Get(ctx context.Context, key string) (data []byte, err error) {
-	p.mutex.RLock()
-	data, exists := p.cache[key]
-	p.mutex.RUnlock()
-
+	data, exists := p.cache.Get(key)
 	if !exists {
 		return nil, cache.ErrNotFound
 	}
@@ -33,14 +53,37 @@ func (p *Provider) Get(ctx context.Context, key string) (data []byte, err error)
 	return data, nil
 }
 
-// Set adds an object to the cache
+// Set adds an object to the cache with the default TTL
 func (p *Provider) Set(ctx context.Context, key string, data []byte) (err error) {
-	p.mutex.Lock()
-	p.cache[key] = data
-	p.mutex.Unlock()
+	p.cache.Add(key, data)
+
+	return nil
+}
+
+// SetWithTTL adds an object to the cache with the given TTL
+// A ttl of zero means that the object doesn't expire
+func (p *Provider) SetWithTTL(ctx context.Context, key string, data []byte, ttl time.Duration) (err error) {
+	p.cache.AddWithTTL(key, data, ttl)
 
 	return nil
 }
 
+// Keys returns the keys of all the objects in the cache, from the most to the least recently used
+func (p *Provider) Keys(ctx context.Context) (keys []string, err error) {
+	return p.cache.Keys(), nil
+}
+
+// Delete removes an object from the cache
+func (p *Provider) Delete(ctx context.Context, key string) (freed int64, err error) {
+	freed, _ = p.cache.Remove(key)
+
+	return freed, nil
+}
+
+// Stats returns statistics about the cache
+func (p *Provider) Stats() lru.Stats {
+	return p.cache.Stats()
+}
+
 // Shutdown shuts down the cache
 func (p *Provider) Shutdown() {}
@@ -3,6 +3,7 @@ package memory_test
 import (
 	"context"
 	"testing"
+	"time"
 
 	"github.com/DMarby/picsum-photos/internal/cache"
 	"github.com/DMarby/picsum-photos/internal/cache/memory"
@@ -12,7 +13,7 @@ func TestMemory(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	provider := memory.New()
+	provider := memory.New(1<<20, 0)
 
 	t.Run("get item", func(t *testing.T) {
 		// Add item to the cache
@@ -39,4 +40,62 @@ func TestMemory(t *testing.T) {
 			t.Fatalf("wrong error %s", err)
 		}
 	})
+
+	t.Run("delete item", func(t *testing.T) {
+		provider.Set(ctx, "baz", []byte("bazz"))
+
+		keys, err := provider.Keys(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(keys) != 2 {
+			t.Fatalf("wrong keys %#v", keys)
+		}
+
+		freed, err := provider.Delete(ctx, "baz")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if freed != 4 {
+			t.Errorf("wrong amount freed %d", freed)
+		}
+
+		if _, err := provider.Get(ctx, "baz"); err != cache.ErrNotFound {
+			t.Errorf("item wasn't deleted")
+		}
+
+		if freed, err := provider.Delete(ctx, "baz"); freed != 0 || err != nil {
+			t.Errorf("wrong result deleting a nonexistant item, %d, %v", freed, err)
+		}
+	})
+}
+
+func TestBounded(t *testing.T) {
+	ctx := context.Background()
+
+	provider := memory.New(10, time.Hour)
+
+	provider.Set(ctx, "a", []byte("aaaa"))
+	provider.Set(ctx, "b", []byte("bbbb"))
+	provider.Get(ctx, "a")
+	provider.Set(ctx, "c", []byte("cccc"))
+
+	if _, err := provider.Get(ctx, "b"); err != cache.ErrNotFound {
+		t.Errorf("least recently used item wasn't evicted, %v", err)
+	}
+
+	// Per-key TTL
+	provider.SetWithTTL(ctx, "a", []byte("aa"), time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+
+	if _, err := provider.Get(ctx, "a"); err != cache.ErrNotFound {
+		t.Errorf("expired item was returned, %v", err)
+	}
+
+	stats := provider.Stats()
+	if stats.Entries != 1 || stats.Bytes != 4 || stats.Evictions != 1 || stats.Expirations != 1 {
+		t.Errorf("wrong stats %#v", stats)
+	}
 }
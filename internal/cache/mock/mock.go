@@ -32,5 +32,19 @@ func (p *Provider) Set(ctx context.Context, key string, data []byte) (err error)
 	return nil
 }
 
+// Keys returns the keys of all the objects in the cache
+func (p *Provider) Keys(ctx context.Context) (keys []string, err error) {
+	return []string{"foo"}, nil
+}
+
+// Delete removes an object from the cache
+func (p *Provider) Delete(ctx context.Context, key string) (freed int64, err error) {
+	if key == "error" {
+		return 0, fmt.Errorf("error")
+	}
+
+	return 3, nil
+}
+
 // Shutdown shuts down the cache
 func (p *Provider) Shutdown() {}
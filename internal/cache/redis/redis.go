@@ -0,0 +1,202 @@
+package redis
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"strings"
+	"time"
+
+	"github.com/DMarby/picsum-photos/internal/breaker"
+	"github.com/DMarby/picsum-photos/internal/cache"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// Prefix for the keys stored in Redis, so that the cache can share a Redis instance with other users
+	keyPrefix = "picsum:cache:"
+
+	// Consecutive failed operations after which Redis is considered down, and how long to use the fallback provider for before trying it again
+	// This way requests don't each have to wait for the timeout while Redis is down
+	breakerThreshold = 5
+	breakerCooldown  = 5 * time.Second
+)
+
+// ErrUnavailable is returned without contacting Redis while the circuit breaker is open
+var ErrUnavailable = errors.New("redis is unavailable")
+
+var (
+	fallbacks         = expvar.NewMap("counter_labelmap_operation_cache_redis_fallbacks")
+	breakerOpens      = expvar.NewInt("counter_cache_redis_breaker_opens")
+	breakerRejections = expvar.NewInt("counter_cache_redis_breaker_rejections")
+)
+
+// Provider implements a cache using Redis, so that it can be shared between instances
+// While Redis is unavailable, objects are cached in the fallback provider instead, if there is one
+type Provider struct {
+	client   *redis.Client
+	fallback cache.Provider
+	ttl      time.Duration
+	timeout  time.Duration
+	breaker  *breaker.Breaker
+}
+
+// New returns a new Provider instance connecting to the Redis server at the url, such as redis://localhost:6379/0
+// Objects expire after ttl, a ttl of zero means that they don't expire, and operations time out after timeout
+// The fallback may be nil, such as when the provider is a tier of a cache.Tiered that already has a local cache in front of it
+func New(url string, ttl time.Duration, timeout time.Duration, fallback cache.Provider) (*Provider, error) {
+	options, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, err
+	}
+
+	options.DialTimeout = timeout
+	options.ReadTimeout = timeout
+	options.WriteTimeout = timeout
+	options.DisableIdentity = true
+
+	return &Provider{
+		client:   redis.NewClient(options),
+		fallback: fallback,
+		ttl:      ttl,
+		timeout:  timeout,
+		breaker: &breaker.Breaker{
+			Threshold: breakerThreshold,
+			Cooldown:  breakerCooldown,
+		},
+	}, nil
+}
+
+// do runs the operation against Redis with a timeout, unless the circuit breaker is open
+func (p *Provider) do(ctx context.Context, operation func(ctx context.Context) error) error {
+	generation, ok := p.breaker.Allow()
+	if !ok {
+		breakerRejections.Add(1)
+		return ErrUnavailable
+	}
+
+	timeoutCtx, cancel := context.WithTimeout(ctx, p.timeout)
+	defer cancel()
+
+	err := operation(timeoutCtx)
+	switch {
+	case err == nil, err == redis.Nil:
+		p.breaker.Success(generation)
+	case ctx.Err() != nil:
+		// Redis didn't fail, the caller went away
+		p.breaker.Release(generation)
+	default:
+		if p.breaker.Failure(generation) {
+			breakerOpens.Add(1)
+		}
+	}
+
+	return err
+}
+
+// Get returns an object from the cache if it exists
+func (p *Provider) Get(ctx context.Context, key string) (data []byte, err error) {
+	err = p.do(ctx, func(ctx context.Context) (err error) {
+		data, err = p.client.Get(ctx, keyPrefix+key).Bytes()
+		return err
+	})
+	if err == redis.Nil {
+		return nil, cache.ErrNotFound
+	}
+
+	if err != nil {
+		if p.fallback == nil {
+			return nil, err
+		}
+
+		fallbacks.Add("get", 1)
+		return p.fallback.Get(ctx, key)
+	}
+
+	return data, nil
+}
+
+// Set adds an object to the cache
+func (p *Provider) Set(ctx context.Context, key string, data []byte) (err error) {
+	err = p.do(ctx, func(ctx context.Context) error {
+		return p.client.Set(ctx, keyPrefix+key, data, p.ttl).Err()
+	})
+	if err != nil {
+		if p.fallback == nil {
+			return err
+		}
+
+		fallbacks.Add("set", 1)
+		return p.fallback.Set(ctx, key, data)
+	}
+
+	return nil
+}
+
+// Keys returns the keys of all the objects in the cache, including the ones in the fallback provider
+func (p *Provider) Keys(ctx context.Context) (keys []string, err error) {
+	err = p.do(ctx, func(ctx context.Context) error {
+		iter := p.client.Scan(ctx, 0, keyPrefix+"*", 1000).Iterator()
+		for iter.Next(ctx) {
+			keys = append(keys, strings.TrimPrefix(iter.Val(), keyPrefix))
+		}
+
+		return iter.Err()
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if p.fallback == nil {
+		return keys, nil
+	}
+
+	fallbackKeys, err := p.fallback.Keys(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(keys, fallbackKeys...), nil
+}
+
+// Delete removes an object from the cache, and from the fallback provider
+func (p *Provider) Delete(ctx context.Context, key string) (freed int64, err error) {
+	var length *redis.IntCmd
+	err = p.do(ctx, func(ctx context.Context) error {
+		_, err := p.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+			length = pipe.StrLen(ctx, keyPrefix+key)
+			pipe.Del(ctx, keyPrefix+key)
+			return nil
+		})
+		return err
+	})
+
+	if p.fallback == nil {
+		if err != nil {
+			return 0, err
+		}
+
+		return length.Val(), nil
+	}
+
+	fallbackFreed, fallbackErr := p.fallback.Delete(ctx, key)
+	if err != nil {
+		return fallbackFreed, errors.Join(err, fallbackErr)
+	}
+
+	return length.Val() + fallbackFreed, fallbackErr
+}
+
+// Ping checks that Redis is available, regardless of the circuit breaker
+// The health checker uses it, as Get succeeds using the fallback provider while Redis is unavailable
+func (p *Provider) Ping(ctx context.Context) error {
+	timeoutCtx, cancel := context.WithTimeout(ctx, p.timeout)
+	defer cancel()
+
+	return p.client.Ping(timeoutCtx).Err()
+}
+
+// Shutdown shuts down the cache
+func (p *Provider) Shutdown() {
+	p.client.Close()
+}
@@ -0,0 +1,420 @@
+package redis_test
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/DMarby/picsum-photos/internal/cache"
+	"github.com/DMarby/picsum-photos/internal/cache/memory"
+	"github.com/DMarby/picsum-photos/internal/cache/redis"
+	"github.com/DMarby/picsum-photos/internal/health"
+	"github.com/DMarby/picsum-photos/internal/logger"
+	"go.uber.org/zap"
+)
+
+// fakeRedis is an in-process stand-in for a Redis server, implementing the commands used by the provider
+type fakeRedis struct {
+	listener net.Listener
+
+	mutex sync.Mutex
+	data  map[string]string
+	conns map[net.Conn]bool
+}
+
+func newFakeRedis(t *testing.T) *fakeRedis {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f := &fakeRedis{
+		listener: listener,
+		data:     make(map[string]string),
+		conns:    make(map[net.Conn]bool),
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			f.mutex.Lock()
+			f.conns[conn] = true
+			f.mutex.Unlock()
+
+			go f.serve(conn)
+		}
+	}()
+
+	t.Cleanup(f.Close)
+
+	return f
+}
+
+func (f *fakeRedis) URL() string {
+	return "redis://" + f.listener.Addr().String()
+}
+
+// Close stops the server and closes all the connections to it
+func (f *fakeRedis) Close() {
+	f.listener.Close()
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	for conn := range f.conns {
+		conn.Close()
+	}
+}
+
+func (f *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+	for {
+		args, err := readCommand(reader)
+		if err != nil {
+			return
+		}
+
+		if _, err := io.WriteString(conn, f.handle(args)); err != nil {
+			return
+		}
+	}
+}
+
+func (f *fakeRedis) handle(args []string) string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	switch strings.ToUpper(args[0]) {
+	case "PING":
+		return "+PONG\r\n"
+	case "GET":
+		value, ok := f.data[args[1]]
+		if !ok {
+			return "$-1\r\n"
+		}
+		return bulk(value)
+	case "SET":
+		f.data[args[1]] = args[2]
+		return "+OK\r\n"
+	case "STRLEN":
+		return fmt.Sprintf(":%d\r\n", len(f.data[args[1]]))
+	case "DEL":
+		_, ok := f.data[args[1]]
+		delete(f.data, args[1])
+		if ok {
+			return ":1\r\n"
+		}
+		return ":0\r\n"
+	case "SCAN":
+		pattern := "*"
+		for i := 2; i < len(args)-1; i++ {
+			if strings.ToUpper(args[i]) == "MATCH" {
+				pattern = args[i+1]
+			}
+		}
+
+		var keys []string
+		for key := range f.data {
+			if ok, _ := path.Match(pattern, key); ok {
+				keys = append(keys, key)
+			}
+		}
+
+		reply := fmt.Sprintf("*2\r\n%s*%d\r\n", bulk("0"), len(keys))
+		for _, key := range keys {
+			reply += bulk(key)
+		}
+		return reply
+	default:
+		return fmt.Sprintf("-ERR unknown command '%s'\r\n", args[0])
+	}
+}
+
+func readCommand(reader *bufio.Reader) ([]string, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+
+	count, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "*")))
+	if err != nil {
+		return nil, err
+	}
+
+	args := make([]string, count)
+	for i := range args {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+
+		length, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "$")))
+		if err != nil {
+			return nil, err
+		}
+
+		buf := make([]byte, length+2)
+		if _, err := io.ReadFull(reader, buf); err != nil {
+			return nil, err
+		}
+
+		args[i] = string(buf[:length])
+	}
+
+	return args, nil
+}
+
+func bulk(value string) string {
+	return fmt.Sprintf("$%d\r\n%s\r\n", len(value), value)
+}
+
+func TestRedis(t *testing.T) {
+	ctx := context.Background()
+
+	server := newFakeRedis(t)
+	fallback := memory.New(1<<20, 0)
+
+	provider, err := redis.New(server.URL(), time.Hour, time.Second, fallback)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer provider.Shutdown()
+
+	t.Run("get item", func(t *testing.T) {
+		if err := provider.Set(ctx, "foo", []byte("bar")); err != nil {
+			t.Fatal(err)
+		}
+
+		data, err := provider.Get(ctx, "foo")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(data) != "bar" {
+			t.Fatal("wrong data")
+		}
+
+		if _, err := fallback.Get(ctx, "foo"); err != cache.ErrNotFound {
+			t.Errorf("item was stored in the fallback provider")
+		}
+	})
+
+	t.Run("get nonexistant item", func(t *testing.T) {
+		_, err := provider.Get(ctx, "notfound")
+		if err != cache.ErrNotFound {
+			t.Fatalf("wrong error %v", err)
+		}
+	})
+
+	t.Run("keys and delete", func(t *testing.T) {
+		provider.Set(ctx, "baz", []byte("bazz"))
+
+		keys, err := provider.Keys(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		sort.Strings(keys)
+		if strings.Join(keys, ",") != "baz,foo" {
+			t.Fatalf("wrong keys %#v", keys)
+		}
+
+		freed, err := provider.Delete(ctx, "baz")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if freed != 4 {
+			t.Errorf("wrong amount freed %d", freed)
+		}
+
+		if _, err := provider.Get(ctx, "baz"); err != cache.ErrNotFound {
+			t.Errorf("item wasn't deleted")
+		}
+	})
+
+	t.Run("ping", func(t *testing.T) {
+		if err := provider.Ping(ctx); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestFallback(t *testing.T) {
+	ctx := context.Background()
+
+	log := logger.New(zap.FatalLevel)
+	defer log.Sync()
+
+	server := newFakeRedis(t)
+	fallback := memory.New(1<<20, 0)
+
+	provider, err := redis.New(server.URL(), time.Hour, 100*time.Millisecond, fallback)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer provider.Shutdown()
+
+	provider.Set(ctx, "foo", []byte("bar"))
+
+	// Take Redis down
+	server.Close()
+
+	if err := provider.Ping(ctx); err == nil {
+		t.Error("no error pinging unavailable redis")
+	}
+
+	// The health checker reports Redis as unhealthy, but the instance stays healthy as the provider keeps working
+	checkerCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	checker := &health.Checker{Ctx: checkerCtx, Cache: provider, Log: log}
+	checker.Run()
+	if status := checker.Status(); !status.Healthy || status.Cache != "healthy" || status.RemoteCache != "unhealthy" {
+		t.Errorf("wrong health status %#v", status)
+	}
+
+	if _, err := provider.Get(ctx, "foo"); err != cache.ErrNotFound {
+		t.Errorf("wrong error %v", err)
+	}
+
+	if err := provider.Set(ctx, "foo", []byte("fallback")); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := provider.Get(ctx, "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(data) != "fallback" {
+		t.Errorf("wrong data %s", data)
+	}
+}
+
+func TestBreaker(t *testing.T) {
+	ctx := context.Background()
+
+	fallback := memory.New(1<<20, 0)
+
+	// Accept connections without ever replying, so that every operation has to wait for the timeout
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	go func() {
+		var conns []net.Conn
+		defer func() {
+			for _, conn := range conns {
+				conn.Close()
+			}
+		}()
+
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conns = append(conns, conn)
+		}
+	}()
+
+	timeout := 200 * time.Millisecond
+	provider, err := redis.New("redis://"+listener.Addr().String(), time.Hour, timeout, fallback)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer provider.Shutdown()
+
+	if err := provider.Set(ctx, "foo", []byte("bar")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Once enough operations have timed out, the following ones go straight to the fallback provider
+	for i := 0; i < 10; i++ {
+		provider.Get(ctx, "foo")
+	}
+
+	start := time.Now()
+	data, err := provider.Get(ctx, "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(data) != "bar" {
+		t.Errorf("wrong data %s", data)
+	}
+
+	if elapsed := time.Since(start); elapsed >= timeout {
+		t.Errorf("waited %s for unavailable redis", elapsed)
+	}
+}
+
+func TestNoFallback(t *testing.T) {
+	ctx := context.Background()
+
+	server := newFakeRedis(t)
+
+	provider, err := redis.New(server.URL(), time.Hour, 100*time.Millisecond, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer provider.Shutdown()
+
+	provider.Set(ctx, "foo", []byte("bar"))
+
+	// Take Redis down
+	server.Close()
+
+	if _, err := provider.Get(ctx, "foo"); err == nil || err == cache.ErrNotFound {
+		t.Errorf("wrong error %v", err)
+	}
+
+	if err := provider.Set(ctx, "foo", []byte("bar")); err == nil {
+		t.Error("no error setting item")
+	}
+
+	// The health checker finds Redis among the tiers of a tiered cache
+	log := logger.New(zap.FatalLevel)
+	defer log.Sync()
+
+	checkerCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	tiered := &cache.Tiered{Providers: []cache.Provider{memory.New(1<<20, 0), provider}}
+	checker := &health.Checker{Ctx: checkerCtx, Cache: tiered, Log: log}
+	checker.Run()
+	if status := checker.Status(); !status.Healthy || status.RemoteCache != "unhealthy" {
+		t.Errorf("wrong health status %#v", status)
+	}
+
+	// Purging still lists the keys of the tiers that work
+	tiered.Set(ctx, "baz", []byte("bazz"))
+	keys, err := tiered.Keys(ctx)
+	if err == nil {
+		t.Error("no error listing the keys of unavailable redis")
+	}
+
+	if len(keys) != 1 || keys[0] != "baz" {
+		t.Errorf("wrong keys %#v", keys)
+	}
+}
@@ -0,0 +1,94 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// Tiered is a cache made up of an ordered chain of providers, such as memory, disk and a remote cache
+// Objects found in a lower tier are promoted to the tiers above it
+type Tiered struct {
+	Providers []Provider // from the fastest to the slowest
+}
+
+// Get returns an object from the first tier that has it, and stores it in the tiers above
+// Tiers that fail are skipped, so that a broken remote cache doesn't prevent loading objects
+func (t *Tiered) Get(ctx context.Context, key string) (data []byte, err error) {
+	for i, provider := range t.Providers {
+		data, err := provider.Get(ctx, key)
+		if err != nil {
+			continue
+		}
+
+		for _, upper := range t.Providers[:i] {
+			upper.Set(ctx, key, data)
+		}
+
+		return data, nil
+	}
+
+	return nil, ErrNotFound
+}
+
+// Set adds an object to all the tiers
+// It only fails if no tier could store the object
+func (t *Tiered) Set(ctx context.Context, key string, data []byte) (err error) {
+	var errs []error
+	for _, provider := range t.Providers {
+		if err := provider.Set(ctx, key, data); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if len(errs) < len(t.Providers) {
+		return nil
+	}
+
+	return errors.Join(errs...)
+}
+
+// Keys returns the keys of all the objects in all the tiers
+// Tiers that fail are skipped, their errors are returned along with the keys from the other tiers, so that those can still be purged
+func (t *Tiered) Keys(ctx context.Context) (keys []string, err error) {
+	var errs []error
+	seen := make(map[string]bool)
+	for i, provider := range t.Providers {
+		providerKeys, err := provider.Keys(ctx)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("tier %d: %w", i, err))
+			continue
+		}
+
+		for _, key := range providerKeys {
+			if !seen[key] {
+				seen[key] = true
+				keys = append(keys, key)
+			}
+		}
+	}
+
+	return keys, errors.Join(errs...)
+}
+
+// Delete removes an object from all the tiers
+// The object is removed from the tiers that work even if others fail
+func (t *Tiered) Delete(ctx context.Context, key string) (freed int64, err error) {
+	var errs []error
+	for i, provider := range t.Providers {
+		providerFreed, err := provider.Delete(ctx, key)
+		freed += providerFreed
+		if err != nil {
+			errs = append(errs, fmt.Errorf("tier %d: %w", i, err))
+		}
+	}
+
+	return freed, errors.Join(errs...)
+}
+
+// Shutdown shuts down all the tiers
+func (t *Tiered) Shutdown() {
+	for _, provider := range t.Providers {
+		provider.Shutdown()
+	}
+}
@@ -0,0 +1,88 @@
+package cache_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/DMarby/picsum-photos/internal/cache"
+	"github.com/DMarby/picsum-photos/internal/cache/memory"
+	"github.com/DMarby/picsum-photos/internal/cache/mock"
+)
+
+func TestTiered(t *testing.T) {
+	ctx := context.Background()
+
+	upper := memory.New(1<<20, 0)
+	lower := memory.New(1<<20, 0)
+	tiered := &cache.Tiered{
+		Providers: []cache.Provider{upper, lower},
+	}
+
+	t.Run("promotes hits", func(t *testing.T) {
+		lower.Set(ctx, "foo", []byte("bar"))
+
+		data, err := tiered.Get(ctx, "foo")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(data) != "bar" {
+			t.Errorf("wrong data %s", data)
+		}
+
+		if _, err := upper.Get(ctx, "foo"); err != nil {
+			t.Errorf("item wasn't promoted, %s", err)
+		}
+	})
+
+	t.Run("sets all tiers", func(t *testing.T) {
+		if err := tiered.Set(ctx, "baz", []byte("bazz")); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, provider := range []cache.Provider{upper, lower} {
+			if _, err := provider.Get(ctx, "baz"); err != nil {
+				t.Error(err)
+			}
+		}
+	})
+
+	t.Run("deletes from all tiers", func(t *testing.T) {
+		freed, err := tiered.Delete(ctx, "baz")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if freed != 8 {
+			t.Errorf("wrong amount freed %d", freed)
+		}
+
+		if _, err := tiered.Get(ctx, "baz"); err != cache.ErrNotFound {
+			t.Errorf("wrong error %v", err)
+		}
+	})
+
+	t.Run("skips failing tiers", func(t *testing.T) {
+		tiered := &cache.Tiered{
+			Providers: []cache.Provider{&mock.Provider{}, lower},
+		}
+
+		// The mock provider fails to get and set these keys
+		lower.Set(ctx, "error", []byte("data"))
+		if data, err := tiered.Get(ctx, "error"); err != nil || string(data) != "data" {
+			t.Errorf("wrong result %s, %v", data, err)
+		}
+
+		if err := tiered.Set(ctx, "seterror", []byte("data")); err != nil {
+			t.Errorf("error setting when one tier works, %s", err)
+		}
+
+		failing := &cache.Tiered{
+			Providers: []cache.Provider{&mock.Provider{}},
+		}
+
+		if err := failing.Set(ctx, "seterror", []byte("data")); err == nil {
+			t.Errorf("no error setting when all tiers fail")
+		}
+	})
+}
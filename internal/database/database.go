@@ -3,6 +3,7 @@ package database
 import (
 	"context"
 	"errors"
+	"fmt"
 )
 
 // Image contains metadata about an image
@@ -12,6 +13,25 @@ type Image struct {
 	Width  int    `json:"width"`
 	Height int    `json:"height"`
 	URL    string `json:"url"`
+	// Hex encoded SHA-256 checksums of the source file, and of the resized variants by their size, the bucket of their largest dimension used by image.Task.SourceKey
+	SHA256        string         `json:"sha256,omitempty"`
+	VariantSHA256 map[int]string `json:"variant_sha256,omitempty"`
+}
+
+// Checksums returns the checksums of the images by their id in the storage, such as 1 and 1_500
+func Checksums(images []Image) map[string]string {
+	checksums := make(map[string]string)
+	for _, image := range images {
+		if image.SHA256 != "" {
+			checksums[image.ID] = image.SHA256
+		}
+
+		for width, checksum := range image.VariantSHA256 {
+			checksums[fmt.Sprintf("%s_%d", image.ID, width)] = checksum
+		}
+	}
+
+	return checksums
 }
 
 // Provider is an interface for listing and retrieving images
@@ -20,10 +40,38 @@ type Provider interface {
 	GetRandom(ctx context.Context) (i *Image, err error)
 	GetRandomWithSeed(ctx context.Context, seed int64) (i *Image, err error)
 	ListAll(ctx context.Context) ([]Image, error)
-	List(ctx context.Context, offset, limit int) ([]Image, error)
+	List(ctx context.Context, filter Filter, sort Sort, offset, limit int) ([]Image, error)
 }
 
 // Errors
 var (
 	ErrNotFound = errors.New("Image does not exist")
 )
+
+// Validate checks that the catalogue can be served, returning all the problems found in it
+func Validate(images []Image) error {
+	if len(images) == 0 {
+		return errors.New("catalogue contains no images")
+	}
+
+	var errs []error
+	seen := make(map[string]int, len(images))
+	for i, image := range images {
+		if image.ID == "" {
+			errs = append(errs, fmt.Errorf("image at index %d has no id", i))
+			continue
+		}
+
+		if first, ok := seen[image.ID]; ok {
+			errs = append(errs, fmt.Errorf("image at index %d has the same id %s as the image at index %d", i, image.ID, first))
+		} else {
+			seen[image.ID] = i
+		}
+
+		if image.Width <= 0 || image.Height <= 0 {
+			errs = append(errs, fmt.Errorf("image %s at index %d has invalid dimensions %dx%d", image.ID, i, image.Width, image.Height))
+		}
+	}
+
+	return errors.Join(errs...)
+}
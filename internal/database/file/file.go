@@ -1,37 +1,119 @@
 package file
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"math"
 	"math/rand"
 	"os"
+	"slices"
 	"sort"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/DMarby/picsum-photos/internal/database"
+	"github.com/DMarby/picsum-photos/internal/logger"
+	"github.com/DMarby/picsum-photos/internal/watch"
+)
+
+var (
+	reloads      = expvar.NewInt("counter_database_file_reloads")
+	reloadErrors = expvar.NewInt("counter_database_file_reload_errors")
 )
 
 // Provider implements a file-based image storage
+// The file can be reloaded while the provider is in use, see Reload and Watch
 type Provider struct {
-	images       []database.Image
-	sortedImages []database.Image
+	path      string
+	catalogue atomic.Pointer[catalogue]
 
 	random *rand.Rand
 	mu     sync.Mutex
 }
 
+// Number of aspect ratio buckets per unit of aspect ratio, so that each bucket covers a range of 0.1
+const aspectRatioBuckets = 10
+
+// catalogue is a loaded, validated, database file
+type catalogue struct {
+	images       []database.Image
+	sortedImages []database.Image
+	info         os.FileInfo
+
+	// Indexes, from a key to the positions of the images in sortedImages, in ascending order
+	byID          map[string]int
+	byAuthor      map[string][]int // by lowercase author
+	byOrientation map[database.Orientation][]int
+	byAspectRatio map[int][]int // by aspect ratio bucket
+}
+
 // New returns a new Provider instance
 func New(path string) (*Provider, error) {
-	data, err := os.ReadFile(path)
+	c, err := load(path)
+	if err != nil {
+		return nil, err
+	}
+
+	source := rand.NewSource(time.Now().UnixNano())
+	random := rand.New(source)
+
+	p := &Provider{
+		path:   path,
+		random: random,
+	}
+	p.catalogue.Store(c)
+
+	if expvar.Get("gauge_database_file_images") == nil {
+		expvar.Publish("gauge_database_file_images", expvar.Func(func() any {
+			return len(p.catalogue.Load().images)
+		}))
+		// The modification time of the loaded file, to tell which version of the catalogue an instance is serving
+		expvar.Publish("gauge_database_file_version", expvar.Func(func() any {
+			return p.catalogue.Load().info.ModTime().Unix()
+		}))
+	}
+
+	return p, nil
+}
+
+func load(path string) (*catalogue, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
 	if err != nil {
 		return nil, err
 	}
 
+	var buf bytes.Buffer
+	if _, err := buf.ReadFrom(file); err != nil {
+		return nil, err
+	}
+	data := buf.Bytes()
+
 	var images []database.Image
 	err = json.Unmarshal(data, &images)
 	if err != nil {
+		var syntaxErr *json.SyntaxError
+		if errors.As(err, &syntaxErr) {
+			line, column := position(data, syntaxErr.Offset)
+			return nil, fmt.Errorf("invalid json at line %d, column %d: %w", line, column, err)
+		}
+
+		return nil, err
+	}
+
+	if err := database.Validate(images); err != nil {
 		return nil, err
 	}
 
@@ -43,24 +125,86 @@ func New(path string) (*Provider, error) {
 		return ii < jj
 	})
 
-	source := rand.NewSource(time.Now().UnixNano())
-	random := rand.New(source)
+	c := &catalogue{
+		images:        images,
+		sortedImages:  sortedImages,
+		info:          info,
+		byID:          make(map[string]int, len(sortedImages)),
+		byAuthor:      make(map[string][]int),
+		byOrientation: make(map[database.Orientation][]int),
+		byAspectRatio: make(map[int][]int),
+	}
+
+	for i := range sortedImages {
+		image := &sortedImages[i]
+		author := strings.ToLower(image.Author)
+		orientation := image.Orientation()
+		bucket := aspectRatioBucket(image.AspectRatio())
+
+		c.byID[image.ID] = i
+		c.byAuthor[author] = append(c.byAuthor[author], i)
+		c.byOrientation[orientation] = append(c.byOrientation[orientation], i)
+		c.byAspectRatio[bucket] = append(c.byAspectRatio[bucket], i)
+	}
+
+	return c, nil
+}
+
+func aspectRatioBucket(aspectRatio float64) int {
+	return int(math.Floor(aspectRatio * aspectRatioBuckets))
+}
+
+// position returns the line and column of the byte offset in the data
+func position(data []byte, offset int64) (line int, column int) {
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+
+	before := data[:offset]
+	line = bytes.Count(before, []byte("\n")) + 1
+	column = int(offset) - bytes.LastIndexByte(before, '\n')
+	return line, column
+}
+
+// Reload reads the database file again, swapping in the new catalogue once it has been validated
+// If the new catalogue is invalid, the provider keeps serving the old one
+func (p *Provider) Reload() error {
+	c, err := load(p.path)
+	if err != nil {
+		reloadErrors.Add(1)
+		return err
+	}
 
-	return &Provider{
-		images:       images,
-		sortedImages: sortedImages,
-		random:       random,
-	}, nil
+	p.catalogue.Store(c)
+	reloads.Add(1)
+	return nil
+}
+
+// Watch reloads the database file when it changes, checking it every interval until the context is done
+func (p *Provider) Watch(ctx context.Context, log *logger.Logger, interval time.Duration) {
+	watch.File(ctx, log, p.path, interval, p.Info, p.Reload)
+}
+
+// Info returns the file info of the loaded database file
+func (p *Provider) Info() os.FileInfo {
+	return p.catalogue.Load().info
+}
+
+// Len returns the number of images
+func (p *Provider) Len() int {
+	return len(p.catalogue.Load().images)
 }
 
 func (p *Provider) getImage(id string) (*database.Image, error) {
-	for _, image := range p.images {
-		if image.ID == id {
-			return &image, nil
-		}
+	c := p.catalogue.Load()
+
+	i, ok := c.byID[id]
+	if !ok {
+		return nil, database.ErrNotFound
 	}
 
-	return nil, database.ErrNotFound
+	image := c.sortedImages[i]
+	return &image, nil
 }
 
 // Get returns the image data for an image id
@@ -75,28 +219,39 @@ func (p *Provider) Get(ctx context.Context, id string) (i *database.Image, err e
 
 // GetRandom returns a random image ID
 func (p *Provider) GetRandom(ctx context.Context) (i *database.Image, err error) {
+	images := p.catalogue.Load().images
+
 	p.mu.Lock()
-	image := &p.images[p.random.Intn(len(p.images))]
+	image := &images[p.random.Intn(len(images))]
 	p.mu.Unlock()
 	return image, nil
 }
 
 // GetRandomWithSeed returns a random image ID based on the given seed
 func (p *Provider) GetRandomWithSeed(ctx context.Context, seed int64) (i *database.Image, err error) {
+	images := p.catalogue.Load().images
+
 	source := rand.NewSource(seed)
 	random := rand.New(source)
 
-	return &p.images[random.Intn(len(p.images))], nil
+	return &images[random.Intn(len(images))], nil
 }
 
 // ListAll returns a list of all the images
 func (p *Provider) ListAll(ctx context.Context) ([]database.Image, error) {
-	return p.sortedImages, nil
+	return p.catalogue.Load().sortedImages, nil
 }
 
-// List returns a list of all the images with an offset/limit
-func (p *Provider) List(ctx context.Context, offset, limit int) ([]database.Image, error) {
-	images := len(p.sortedImages)
+// List returns a sorted list of the images matching the filter with an offset/limit
+func (p *Provider) List(ctx context.Context, filter database.Filter, order database.Sort, offset, limit int) ([]database.Image, error) {
+	c := p.catalogue.Load()
+	if !filter.IsZero() || !order.IsZero() {
+		return c.list(filter, order, offset, limit), nil
+	}
+
+	sortedImages := c.sortedImages
+
+	images := len(sortedImages)
 	if offset > images {
 		offset = images
 	}
@@ -106,5 +261,103 @@ func (p *Provider) List(ctx context.Context, offset, limit int) ([]database.Imag
 		limit = images
 	}
 
-	return p.sortedImages[offset:limit], nil
+	return sortedImages[offset:limit], nil
+}
+
+// list returns the sorted images matching the filter with an offset/limit, using the indexes to find them
+func (c *catalogue) list(filter database.Filter, order database.Sort, offset, limit int) []database.Image {
+	positions, ok := c.candidates(filter)
+	if !ok {
+		positions = make([]int, len(c.sortedImages))
+		for i := range positions {
+			positions[i] = i
+		}
+	}
+
+	// The positions are sorted by id, so other fields need the matching images to be sorted first
+	if order.Field != "" && order.Field != database.SortID {
+		matches := []database.Image{}
+		for _, i := range positions {
+			if filter.Matches(&c.sortedImages[i]) {
+				matches = append(matches, c.sortedImages[i])
+			}
+		}
+
+		slices.SortStableFunc(matches, func(a, b database.Image) int {
+			return order.Compare(&a, &b)
+		})
+
+		offset = min(offset, len(matches))
+		return matches[offset:min(offset+limit, len(matches))]
+	}
+
+	images := []database.Image{}
+	for n := range positions {
+		if len(images) >= limit {
+			break
+		}
+
+		i := positions[n]
+		if order.Descending {
+			i = positions[len(positions)-1-n]
+		}
+
+		if !filter.Matches(&c.sortedImages[i]) {
+			continue
+		}
+
+		if offset > 0 {
+			offset--
+			continue
+		}
+
+		images = append(images, c.sortedImages[i])
+	}
+
+	return images
+}
+
+// candidates returns the positions in sortedImages of the images that may match the filter, in ascending order
+// It uses the most selective index for the filter, returning false if no index applies
+func (c *catalogue) candidates(filter database.Filter) ([]int, bool) {
+	var lists [][]int
+
+	if filter.Author != "" {
+		lists = append(lists, c.byAuthor[strings.ToLower(filter.Author)])
+	}
+
+	if filter.Orientation != "" {
+		lists = append(lists, c.byOrientation[filter.Orientation])
+	}
+
+	if filter.MinAspectRatio != 0 || filter.MaxAspectRatio != 0 {
+		minBucket := aspectRatioBucket(filter.MinAspectRatio)
+		maxBucket := math.MaxInt
+		if filter.MaxAspectRatio != 0 {
+			maxBucket = aspectRatioBucket(filter.MaxAspectRatio)
+		}
+
+		var positions []int
+		for bucket, bucketPositions := range c.byAspectRatio {
+			if bucket >= minBucket && bucket <= maxBucket {
+				positions = append(positions, bucketPositions...)
+			}
+		}
+		sort.Ints(positions)
+
+		lists = append(lists, positions)
+	}
+
+	if len(lists) == 0 {
+		return nil, false
+	}
+
+	shortest := lists[0]
+	for _, list := range lists[1:] {
+		if len(list) < len(shortest) {
+			shortest = list
+		}
+	}
+
+	return shortest, true
 }
@@ -2,10 +2,16 @@ package file_test
 
 import (
 	"context"
+	"os"
+	"path/filepath"
 	"reflect"
+	"strings"
+	"time"
 
 	"github.com/DMarby/picsum-photos/internal/database"
 	"github.com/DMarby/picsum-photos/internal/database/file"
+	"github.com/DMarby/picsum-photos/internal/logger"
+	"go.uber.org/zap"
 
 	"testing"
 )
@@ -87,7 +93,7 @@ func TestFile(t *testing.T) {
 	})
 
 	t.Run("Returns a list of images", func(t *testing.T) {
-		images, err := provider.List(ctx, 1, 1)
+		images, err := provider.List(ctx, database.Filter{}, database.Sort{}, 1, 1)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -98,7 +104,7 @@ func TestFile(t *testing.T) {
 	})
 
 	t.Run("Handles offset and limit larger then db", func(t *testing.T) {
-		_, err := provider.List(ctx, 10, 30)
+		_, err := provider.List(ctx, database.Filter{}, database.Sort{}, 10, 30)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -114,7 +120,141 @@ func TestMissingMetadata(t *testing.T) {
 
 func TestInvalidJson(t *testing.T) {
 	_, err := file.New("../../../test/fixtures/file/invalid_metadata.json")
+	if err == nil || !strings.Contains(err.Error(), "line 9") {
+		t.Fatalf("wrong error %v", err)
+	}
+}
+
+func TestInvalidCatalogue(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metadata.json")
+	os.WriteFile(path, []byte(`[{"id": "1", "width": 300, "height": 400}, {"id": "1", "width": 0, "height": 400}]`), 0644)
+
+	_, err := file.New(path)
 	if err == nil {
 		t.FailNow()
 	}
+
+	for _, problem := range []string{"same id 1", "invalid dimensions 0x400"} {
+		if !strings.Contains(err.Error(), problem) {
+			t.Errorf("error %v doesn't mention %s", err, problem)
+		}
+	}
+}
+
+func TestReload(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	log := logger.New(zap.FatalLevel)
+	defer log.Sync()
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "metadata.json")
+
+	data, _ := os.ReadFile("../../../test/fixtures/file/metadata.json")
+	os.WriteFile(path, data, 0644)
+
+	provider, err := file.New(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go provider.Watch(ctx, log, 10*time.Millisecond)
+
+	t.Run("Keeps the old catalogue if the new one is invalid", func(t *testing.T) {
+		os.WriteFile(path, []byte("[]"), 0644)
+
+		if err := provider.Reload(); err == nil {
+			t.Error("no error reloading an invalid catalogue")
+		}
+
+		if _, err := provider.Get(ctx, "1"); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("Swaps in the new catalogue", func(t *testing.T) {
+		data, _ := os.ReadFile("../../../test/fixtures/file/metadata_multiple.json")
+
+		// Replace the file, as a deploy would, so that the watcher doesn't see a partially written file
+		newPath := filepath.Join(dir, "metadata.json.new")
+		os.WriteFile(newPath, data, 0644)
+		os.Rename(newPath, path)
+
+		deadline := time.Now().Add(time.Second)
+		for provider.Len() != 2 && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		if _, err := provider.Get(ctx, "2"); err != nil {
+			t.Fatal(err)
+		}
+
+		images, err := provider.ListAll(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !reflect.DeepEqual(images, []database.Image{image, secondImage}) {
+			t.Error("image data doesn't match")
+		}
+	})
+}
+
+func TestFilter(t *testing.T) {
+	ctx := context.Background()
+
+	path := filepath.Join(t.TempDir(), "metadata.json")
+	os.WriteFile(path, []byte(`[
+		{"id": "1", "author": "John Doe", "width": 600, "height": 400},
+		{"id": "2", "author": "Jane Doe", "width": 400, "height": 600},
+		{"id": "3", "author": "John Doe", "width": 500, "height": 500},
+		{"id": "4", "author": "john doe", "width": 1600, "height": 900},
+		{"id": "5", "author": "Jane Doe", "width": 800, "height": 400}
+	]`), 0644)
+
+	provider, err := file.New(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		Name     string
+		Filter   database.Filter
+		Sort     database.Sort
+		Offset   int
+		Limit    int
+		Expected []string
+	}{
+		{"author", database.Filter{Author: "John Doe"}, database.Sort{}, 0, 30, []string{"1", "3", "4"}},
+		{"unknown author", database.Filter{Author: "Nobody"}, database.Sort{}, 0, 30, []string{}},
+		{"orientation", database.Filter{Orientation: database.OrientationLandscape}, database.Sort{}, 0, 30, []string{"1", "4", "5"}},
+		{"square", database.Filter{Orientation: database.OrientationSquare}, database.Sort{}, 0, 30, []string{"3"}},
+		{"aspect ratio range", database.Filter{MinAspectRatio: 1.5, MaxAspectRatio: 1.8}, database.Sort{}, 0, 30, []string{"1", "4"}},
+		{"min aspect ratio", database.Filter{MinAspectRatio: 1.7}, database.Sort{}, 0, 30, []string{"4", "5"}},
+		{"combined", database.Filter{Author: "jane doe", Orientation: database.OrientationLandscape}, database.Sort{}, 0, 30, []string{"5"}},
+		{"offset and limit", database.Filter{Orientation: database.OrientationLandscape}, database.Sort{}, 1, 1, []string{"4"}},
+		{"dimensions", database.Filter{MinWidth: 500, MaxHeight: 500}, database.Sort{}, 0, 30, []string{"1", "3", "5"}},
+		{"sort by id descending", database.Filter{}, database.Sort{Descending: true}, 1, 2, []string{"4", "3"}},
+		{"sort by width", database.Filter{}, database.Sort{Field: database.SortWidth}, 0, 30, []string{"2", "3", "1", "5", "4"}},
+		{"sort by height descending", database.Filter{}, database.Sort{Field: database.SortHeight, Descending: true}, 0, 30, []string{"4", "2", "3", "1", "5"}},
+		{"sort by author", database.Filter{Orientation: database.OrientationLandscape}, database.Sort{Field: database.SortAuthor}, 0, 2, []string{"5", "1"}},
+		{"sort with offset past the end", database.Filter{}, database.Sort{Field: database.SortWidth}, 10, 30, []string{}},
+	}
+
+	for _, test := range tests {
+		images, err := provider.List(ctx, test.Filter, test.Sort, test.Offset, test.Limit)
+		if err != nil {
+			t.Fatalf("%s: %s", test.Name, err)
+		}
+
+		ids := []string{}
+		for _, image := range images {
+			ids = append(ids, image.ID)
+		}
+
+		if !reflect.DeepEqual(ids, test.Expected) {
+			t.Errorf("%s: wrong images %v", test.Name, ids)
+		}
+	}
 }
@@ -0,0 +1,137 @@
+package database
+
+import (
+	"cmp"
+	"strconv"
+	"strings"
+)
+
+// Orientation is the orientation of an image
+type Orientation string
+
+// Orientations
+const (
+	OrientationLandscape Orientation = "landscape"
+	OrientationPortrait  Orientation = "portrait"
+	OrientationSquare    Orientation = "square"
+)
+
+// Orientation returns the orientation of the image
+func (i *Image) Orientation() Orientation {
+	switch {
+	case i.Width > i.Height:
+		return OrientationLandscape
+	case i.Width < i.Height:
+		return OrientationPortrait
+	default:
+		return OrientationSquare
+	}
+}
+
+// AspectRatio returns the width of the image divided by its height
+func (i *Image) AspectRatio() float64 {
+	if i.Height == 0 {
+		return 0
+	}
+
+	return float64(i.Width) / float64(i.Height)
+}
+
+// Filter restricts the images returned by List, the zero value matches all images
+type Filter struct {
+	Author      string // matched case-insensitively
+	Orientation Orientation
+	// Dimension ranges in pixels, zero means unbounded
+	MinWidth  int
+	MaxWidth  int
+	MinHeight int
+	MaxHeight int
+	// Aspect ratio range, as width divided by height, zero means unbounded
+	MinAspectRatio float64
+	MaxAspectRatio float64
+}
+
+// IsZero returns whether the filter matches all images
+func (f Filter) IsZero() bool {
+	return f == Filter{}
+}
+
+// Matches returns whether the image matches the filter
+func (f Filter) Matches(image *Image) bool {
+	if f.Author != "" && !strings.EqualFold(image.Author, f.Author) {
+		return false
+	}
+
+	if f.Orientation != "" && image.Orientation() != f.Orientation {
+		return false
+	}
+
+	if (f.MinWidth != 0 && image.Width < f.MinWidth) || (f.MaxWidth != 0 && image.Width > f.MaxWidth) {
+		return false
+	}
+
+	if (f.MinHeight != 0 && image.Height < f.MinHeight) || (f.MaxHeight != 0 && image.Height > f.MaxHeight) {
+		return false
+	}
+
+	aspectRatio := image.AspectRatio()
+	if f.MinAspectRatio != 0 && aspectRatio < f.MinAspectRatio {
+		return false
+	}
+
+	if f.MaxAspectRatio != 0 && aspectRatio > f.MaxAspectRatio {
+		return false
+	}
+
+	return true
+}
+
+// SortField is a field images can be sorted by
+type SortField string
+
+// Sort fields
+const (
+	SortID     SortField = "id"
+	SortWidth  SortField = "width"
+	SortHeight SortField = "height"
+	SortAuthor SortField = "author" // sorted case-insensitively
+)
+
+// Sort is the order of the images returned by List, the zero value sorts them by id in ascending order
+// Images with the same value for the field are sorted by id in ascending order
+type Sort struct {
+	Field      SortField
+	Descending bool
+}
+
+// IsZero returns whether the sort is the default order
+func (s Sort) IsZero() bool {
+	return (s.Field == "" || s.Field == SortID) && !s.Descending
+}
+
+// Compare compares two images by the sort field, returning a negative number if a sorts before b, and a positive one if after
+func (s Sort) Compare(a *Image, b *Image) int {
+	var result int
+	switch s.Field {
+	case SortWidth:
+		result = cmp.Compare(a.Width, b.Width)
+	case SortHeight:
+		result = cmp.Compare(a.Height, b.Height)
+	case SortAuthor:
+		result = strings.Compare(strings.ToLower(a.Author), strings.ToLower(b.Author))
+	default:
+		result = cmp.Compare(idNumber(a.ID), idNumber(b.ID))
+	}
+
+	if s.Descending {
+		return -result
+	}
+
+	return result
+}
+
+// idNumber returns the numeric value of an image id, ids are sorted numerically
+func idNumber(id string) int {
+	number, _ := strconv.Atoi(id)
+	return number
+}
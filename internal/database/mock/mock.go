@@ -31,7 +31,7 @@ func (p *Provider) ListAll(ctx context.Context) ([]database.Image, error) {
 	return nil, fmt.Errorf("list error")
 }
 
-// List returns a list of all the images with an offset/limit
-func (p *Provider) List(ctx context.Context, offset, limit int) ([]database.Image, error) {
+// List returns a sorted list of the images matching the filter with an offset/limit
+func (p *Provider) List(ctx context.Context, filter database.Filter, sort database.Sort, offset, limit int) ([]database.Image, error) {
 	return nil, fmt.Errorf("list error")
 }
@@ -0,0 +1,73 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+// migrations are applied in order, the schema version is tracked in the user_version pragma
+// Never change a migration once released, add a new one instead
+var migrations = []string{
+	// 1: images, position is the order of the image in the imported catalogue
+	// author_lower is lowercased in Go, as SQLite only folds the case of ASCII characters
+	`CREATE TABLE images (
+		position INTEGER PRIMARY KEY,
+		id TEXT NOT NULL UNIQUE,
+		author TEXT NOT NULL,
+		author_lower TEXT NOT NULL,
+		width INTEGER NOT NULL,
+		height INTEGER NOT NULL,
+		url TEXT NOT NULL,
+		sha256 TEXT NOT NULL DEFAULT '',
+		variant_sha256 TEXT NOT NULL DEFAULT 'null'
+	);
+	CREATE INDEX images_id_number ON images (CAST(id AS INTEGER), id);
+	CREATE INDEX images_author ON images (author_lower);`,
+}
+
+// migrate applies the migrations that haven't been applied to the database yet
+func migrate(ctx context.Context, db *sql.DB) error {
+	// Use a single connection, as the pragma and the transactions need to run on the same one
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	var version int
+	if err := conn.QueryRowContext(ctx, "PRAGMA user_version").Scan(&version); err != nil {
+		return err
+	}
+
+	if version > len(migrations) {
+		return fmt.Errorf("database schema version %d is newer than the latest known version %d", version, len(migrations))
+	}
+
+	for i := version; i < len(migrations); i++ {
+		if err := applyMigration(ctx, conn, i+1, migrations[i]); err != nil {
+			return fmt.Errorf("error applying migration %d: %w", i+1, err)
+		}
+	}
+
+	return nil
+}
+
+func applyMigration(ctx context.Context, conn *sql.Conn, version int, migration string) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, migration); err != nil {
+		return err
+	}
+
+	// Pragmas don't support parameters
+	if _, err := tx.ExecContext(ctx, fmt.Sprintf("PRAGMA user_version = %d", version)); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
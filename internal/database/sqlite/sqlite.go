@@ -0,0 +1,277 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/DMarby/picsum-photos/internal/database"
+
+	_ "modernc.org/sqlite"
+)
+
+// Provider implements an image database using SQLite
+type Provider struct {
+	db *sql.DB
+
+	random *rand.Rand
+	mu     sync.Mutex
+}
+
+// New returns a new Provider instance for the database at path, creating it and applying migrations as needed
+func New(path string) (*Provider, error) {
+	// WAL lets readers proceed while an import or admin edit is writing
+	// The path is escaped, as SQLite parses the DSN as a URI, where characters such as ? and # have special meanings
+	dsn := "file:" + (&url.URL{Path: path}).EscapedPath() + "?" + url.Values{
+		"_pragma": {"busy_timeout(5000)", "journal_mode(WAL)"},
+	}.Encode()
+
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := migrate(context.Background(), db); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("error migrating database: %w", err)
+	}
+
+	source := rand.NewSource(time.Now().UnixNano())
+	random := rand.New(source)
+
+	return &Provider{
+		db:     db,
+		random: random,
+	}, nil
+}
+
+// Close closes the database
+func (p *Provider) Close() error {
+	return p.db.Close()
+}
+
+// The columns of an image, in the order scanImage expects them
+const imageColumns = "id, author, width, height, url, sha256, variant_sha256"
+
+// Sort images numerically by their id, like the file provider
+const orderByID = "CAST(id AS INTEGER), id"
+
+type scanner interface {
+	Scan(dest ...any) error
+}
+
+func scanImage(row scanner) (*database.Image, error) {
+	var image database.Image
+	var variants string
+	if err := row.Scan(&image.ID, &image.Author, &image.Width, &image.Height, &image.URL, &image.SHA256, &variants); err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal([]byte(variants), &image.VariantSHA256); err != nil {
+		return nil, err
+	}
+
+	return &image, nil
+}
+
+func (p *Provider) query(ctx context.Context, query string, args ...any) ([]database.Image, error) {
+	rows, err := p.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	images := []database.Image{}
+	for rows.Next() {
+		image, err := scanImage(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		images = append(images, *image)
+	}
+
+	return images, rows.Err()
+}
+
+// Get returns the image data for an image id
+func (p *Provider) Get(ctx context.Context, id string) (i *database.Image, err error) {
+	image, err := scanImage(p.db.QueryRowContext(ctx, "SELECT "+imageColumns+" FROM images WHERE id = ?", id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, database.ErrNotFound
+	}
+
+	return image, err
+}
+
+// getByPosition returns the image at the position in the imported catalogue, picking it using random
+// Images are picked the same way as in the file provider, so that seeds select the same image for the same catalogue
+// The count and the image are read in the same transaction, so that they're consistent with imports by other processes
+func (p *Provider) getByPosition(ctx context.Context, pick func(n int) int) (*database.Image, error) {
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// Import assigns contiguous positions starting from 0, so this is an index lookup rather than a scan like COUNT(*)
+	var count int
+	if err := tx.QueryRowContext(ctx, "SELECT COALESCE(MAX(position) + 1, 0) FROM images").Scan(&count); err != nil {
+		return nil, err
+	}
+
+	if count == 0 {
+		return nil, database.ErrNotFound
+	}
+
+	return scanImage(tx.QueryRowContext(ctx, "SELECT "+imageColumns+" FROM images WHERE position = ?", pick(count)))
+}
+
+// GetRandom returns a random image
+func (p *Provider) GetRandom(ctx context.Context) (i *database.Image, err error) {
+	return p.getByPosition(ctx, func(n int) int {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+
+		return p.random.Intn(n)
+	})
+}
+
+// GetRandomWithSeed returns a random image based on the given seed
+func (p *Provider) GetRandomWithSeed(ctx context.Context, seed int64) (i *database.Image, err error) {
+	return p.getByPosition(ctx, func(n int) int {
+		source := rand.NewSource(seed)
+		random := rand.New(source)
+
+		return random.Intn(n)
+	})
+}
+
+// ListAll returns a list of all the images
+func (p *Provider) ListAll(ctx context.Context) ([]database.Image, error) {
+	return p.query(ctx, "SELECT "+imageColumns+" FROM images ORDER BY "+orderByID)
+}
+
+// List returns a sorted list of the images matching the filter with an offset/limit
+func (p *Provider) List(ctx context.Context, filter database.Filter, order database.Sort, offset, limit int) ([]database.Image, error) {
+	var conditions []string
+	var args []any
+
+	if filter.Author != "" {
+		conditions = append(conditions, "author_lower = ?")
+		args = append(args, strings.ToLower(filter.Author))
+	}
+
+	switch filter.Orientation {
+	case database.OrientationLandscape:
+		conditions = append(conditions, "width > height")
+	case database.OrientationPortrait:
+		conditions = append(conditions, "width < height")
+	case database.OrientationSquare:
+		conditions = append(conditions, "width = height")
+	}
+
+	bounds := []struct {
+		condition string
+		value     int
+	}{
+		{"width >= ?", filter.MinWidth},
+		{"width <= ?", filter.MaxWidth},
+		{"height >= ?", filter.MinHeight},
+		{"height <= ?", filter.MaxHeight},
+	}
+	for _, bound := range bounds {
+		if bound.value != 0 {
+			conditions = append(conditions, bound.condition)
+			args = append(args, bound.value)
+		}
+	}
+
+	if filter.MinAspectRatio != 0 {
+		conditions = append(conditions, "CAST(width AS REAL) / height >= ?")
+		args = append(args, filter.MinAspectRatio)
+	}
+
+	if filter.MaxAspectRatio != 0 {
+		conditions = append(conditions, "CAST(width AS REAL) / height <= ?")
+		args = append(args, filter.MaxAspectRatio)
+	}
+
+	query := "SELECT " + imageColumns + " FROM images"
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	query += " ORDER BY " + orderBy(order) + " LIMIT ? OFFSET ?"
+
+	return p.query(ctx, query, append(args, limit, offset)...)
+}
+
+// orderBy returns the ORDER BY clause for the sort, images with the same value are sorted by id in ascending order
+func orderBy(order database.Sort) string {
+	direction := "ASC"
+	if order.Descending {
+		direction = "DESC"
+	}
+
+	switch order.Field {
+	case database.SortWidth:
+		return "width " + direction + ", " + orderByID
+	case database.SortHeight:
+		return "height " + direction + ", " + orderByID
+	case database.SortAuthor:
+		return "author_lower " + direction + ", " + orderByID
+	default:
+		return "CAST(id AS INTEGER) " + direction + ", id " + direction
+	}
+}
+
+// Import replaces the images in the database with the images, keeping their order for random selection
+// Existing images are updated rather than replaced, so that columns that aren't part of the manifest are kept, and images that aren't in the manifest are removed
+func (p *Provider) Import(ctx context.Context, images []database.Image) error {
+	if err := database.Validate(images); err != nil {
+		return err
+	}
+
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Move the existing images out of the way of the new positions, the images that are still negative afterwards aren't in the manifest
+	if _, err := tx.ExecContext(ctx, "UPDATE images SET position = -1 - position"); err != nil {
+		return err
+	}
+
+	stmt, err := tx.PrepareContext(ctx, "INSERT INTO images (position, author_lower, "+imageColumns+") VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?) "+
+		"ON CONFLICT (id) DO UPDATE SET position = excluded.position, author_lower = excluded.author_lower, author = excluded.author, "+
+		"width = excluded.width, height = excluded.height, url = excluded.url, sha256 = excluded.sha256, variant_sha256 = excluded.variant_sha256")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for i, image := range images {
+		variants, err := json.Marshal(image.VariantSHA256)
+		if err != nil {
+			return err
+		}
+
+		if _, err := stmt.ExecContext(ctx, i, strings.ToLower(image.Author), image.ID, image.Author, image.Width, image.Height, image.URL, image.SHA256, string(variants)); err != nil {
+			return fmt.Errorf("error importing image %s: %w", image.ID, err)
+		}
+	}
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM images WHERE position < 0"); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,380 @@
+package sqlite_test
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/DMarby/picsum-photos/internal/database"
+	"github.com/DMarby/picsum-photos/internal/database/file"
+	"github.com/DMarby/picsum-photos/internal/database/sqlite"
+)
+
+var images = []database.Image{
+	{ID: "10", Author: "John Doe", Width: 600, Height: 400, URL: "https://picsum.photos", SHA256: "abc", VariantSHA256: map[int]string{500: "def"}},
+	{ID: "2", Author: "Jane Doe", Width: 400, Height: 600, URL: "https://picsum.photos"},
+	{ID: "3", Author: "John Doe", Width: 500, Height: 500, URL: "https://picsum.photos"},
+	{ID: "1", Author: "john doe", Width: 1600, Height: 900, URL: "https://picsum.photos"},
+	{ID: "5", Author: "Jane Doe", Width: 800, Height: 400, URL: "https://picsum.photos"},
+}
+
+func newProvider(t *testing.T) (*sqlite.Provider, string) {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "picsum.db")
+	provider, err := sqlite.New(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { provider.Close() })
+
+	if err := provider.Import(context.Background(), images); err != nil {
+		t.Fatal(err)
+	}
+
+	return provider, path
+}
+
+func TestSQLite(t *testing.T) {
+	ctx := context.Background()
+
+	provider, _ := newProvider(t)
+
+	t.Run("Get an image by id", func(t *testing.T) {
+		image, err := provider.Get(ctx, "10")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !reflect.DeepEqual(image, &images[0]) {
+			t.Errorf("image data doesn't match %#v", image)
+		}
+	})
+
+	t.Run("Returns error on a nonexistant image", func(t *testing.T) {
+		_, err := provider.Get(ctx, "nonexistant")
+		if err != database.ErrNotFound {
+			t.Fatalf("wrong error %v", err)
+		}
+	})
+
+	t.Run("Returns a random image", func(t *testing.T) {
+		image, err := provider.GetRandom(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if image.ID == "" {
+			t.Error("wrong image")
+		}
+	})
+
+	t.Run("Returns a list of all the images", func(t *testing.T) {
+		all, err := provider.ListAll(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if ids(all) != "1,2,3,5,10" {
+			t.Errorf("wrong images %s", ids(all))
+		}
+	})
+
+	t.Run("Returns a filtered list of images", func(t *testing.T) {
+		tests := []struct {
+			Filter   database.Filter
+			Sort     database.Sort
+			Offset   int
+			Limit    int
+			Expected string
+		}{
+			{database.Filter{}, database.Sort{}, 1, 2, "2,3"},
+			{database.Filter{Author: "JOHN DOE"}, database.Sort{}, 0, 30, "1,3,10"},
+			{database.Filter{Orientation: database.OrientationLandscape}, database.Sort{}, 0, 30, "1,5,10"},
+			{database.Filter{Orientation: database.OrientationSquare}, database.Sort{}, 0, 30, "3"},
+			{database.Filter{MinAspectRatio: 1.5, MaxAspectRatio: 1.8}, database.Sort{}, 0, 30, "1,10"},
+			{database.Filter{Author: "Jane Doe", Orientation: database.OrientationPortrait}, database.Sort{}, 0, 30, "2"},
+			{database.Filter{Author: "Nobody"}, database.Sort{}, 0, 30, ""},
+			{database.Filter{MinWidth: 500, MaxHeight: 500}, database.Sort{}, 0, 30, "3,5,10"},
+			{database.Filter{}, database.Sort{Descending: true}, 0, 2, "10,5"},
+			{database.Filter{}, database.Sort{Field: database.SortWidth}, 0, 30, "2,3,10,5,1"},
+			{database.Filter{}, database.Sort{Field: database.SortHeight, Descending: true}, 0, 30, "1,2,3,5,10"},
+			{database.Filter{Orientation: database.OrientationLandscape}, database.Sort{Field: database.SortAuthor}, 0, 30, "5,1,10"},
+		}
+
+		for _, test := range tests {
+			list, err := provider.List(ctx, test.Filter, test.Sort, test.Offset, test.Limit)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if ids(list) != test.Expected {
+				t.Errorf("%+v: wrong images %s", test.Filter, ids(list))
+			}
+		}
+	})
+
+	t.Run("Rejects an invalid import", func(t *testing.T) {
+		if err := provider.Import(ctx, []database.Image{{ID: "1"}}); err == nil {
+			t.Error("no error importing an invalid catalogue")
+		}
+
+		// The previous catalogue is kept
+		if _, err := provider.Get(ctx, "10"); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+// Seeded selection has to pick the same image as the file provider, so that seeded urls don't change when switching
+func TestSeedMatchesFile(t *testing.T) {
+	ctx := context.Background()
+
+	provider, _ := newProvider(t)
+
+	path := filepath.Join(t.TempDir(), "metadata.json")
+	data, _ := json.Marshal(images)
+	os.WriteFile(path, data, 0644)
+
+	fileProvider, err := file.New(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for seed := int64(0); seed < 50; seed++ {
+		expected, err := fileProvider.GetRandomWithSeed(ctx, seed)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		image, err := provider.GetRandomWithSeed(ctx, seed)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if image.ID != expected.ID {
+			t.Errorf("seed %d: got image %s, expected %s", seed, image.ID, expected.ID)
+		}
+	}
+}
+
+// Authors have to match the same way as in the file provider, including for non-ASCII characters that SQLite doesn't fold
+func TestAuthorMatchesFile(t *testing.T) {
+	ctx := context.Background()
+
+	catalogue := []database.Image{
+		{ID: "1", Author: "Émile Zola", Width: 600, Height: 400, URL: "https://picsum.photos"},
+		{ID: "2", Author: "ÉMILE ZOLA", Width: 400, Height: 600, URL: "https://picsum.photos"},
+		{ID: "3", Author: "Øystein", Width: 500, Height: 500, URL: "https://picsum.photos"},
+		{ID: "4", Author: "Anna", Width: 800, Height: 400, URL: "https://picsum.photos"},
+	}
+
+	provider, err := sqlite.New(filepath.Join(t.TempDir(), "picsum.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer provider.Close()
+
+	if err := provider.Import(ctx, catalogue); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "metadata.json")
+	data, _ := json.Marshal(catalogue)
+	os.WriteFile(path, data, 0644)
+
+	fileProvider, err := file.New(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		Filter database.Filter
+		Sort   database.Sort
+	}{
+		{database.Filter{Author: "émile zola"}, database.Sort{}},
+		{database.Filter{Author: "øystein"}, database.Sort{}},
+		{database.Filter{}, database.Sort{Field: database.SortAuthor}},
+		{database.Filter{}, database.Sort{Field: database.SortAuthor, Descending: true}},
+	}
+
+	for _, test := range tests {
+		expected, err := fileProvider.List(ctx, test.Filter, test.Sort, 0, 30)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		list, err := provider.List(ctx, test.Filter, test.Sort, 0, 30)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if ids(list) != ids(expected) {
+			t.Errorf("%+v %+v: got images %s, expected %s", test.Filter, test.Sort, ids(list), ids(expected))
+		}
+	}
+}
+
+// Another process, such as database-import, can replace the catalogue while the database is open
+func TestImportByOtherProcess(t *testing.T) {
+	ctx := context.Background()
+
+	// SQLite parses the path as part of a URI
+	path := filepath.Join(t.TempDir(), "a?b#c%d", "picsum.db")
+	os.MkdirAll(filepath.Dir(path), 0755)
+
+	provider, err := sqlite.New(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer provider.Close()
+
+	if err := provider.Import(ctx, images); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("database wasn't created at the path: %s", err)
+	}
+
+	other, err := sqlite.New(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+
+	if err := other.Import(ctx, images[:1]); err != nil {
+		t.Fatal(err)
+	}
+
+	for seed := int64(0); seed < 20; seed++ {
+		image, err := provider.GetRandomWithSeed(ctx, seed)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if image.ID != images[0].ID {
+			t.Errorf("seed %d: got image %s from the previous catalogue", seed, image.ID)
+		}
+	}
+
+	// A larger catalogue is picked from right away, the same way as the file provider
+	reordered := []database.Image{images[3], images[1], images[4], images[0], images[2]}
+	if err := other.Import(ctx, reordered); err != nil {
+		t.Fatal(err)
+	}
+
+	filePath := filepath.Join(t.TempDir(), "metadata.json")
+	data, _ := json.Marshal(reordered)
+	os.WriteFile(filePath, data, 0644)
+
+	fileProvider, err := file.New(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for seed := int64(0); seed < 50; seed++ {
+		expected, err := fileProvider.GetRandomWithSeed(ctx, seed)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		image, err := provider.GetRandomWithSeed(ctx, seed)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if image.ID != expected.ID {
+			t.Errorf("seed %d: got image %s, expected %s", seed, image.ID, expected.ID)
+		}
+	}
+}
+
+// Importing updates the existing images instead of replacing them, so that data that isn't part of the manifest is kept
+func TestReimport(t *testing.T) {
+	ctx := context.Background()
+
+	provider, path := newProvider(t)
+
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if _, err := db.ExecContext(ctx, "ALTER TABLE images ADD COLUMN notes TEXT NOT NULL DEFAULT ''"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := db.ExecContext(ctx, "UPDATE images SET notes = 'edited' WHERE id = '1'"); err != nil {
+		t.Fatal(err)
+	}
+
+	updated := images[3]
+	updated.Author = "Jane Doe"
+	if err := provider.Import(ctx, []database.Image{updated, images[0], {ID: "6", Author: "John Doe", Width: 300, Height: 300, URL: "https://picsum.photos"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	var notes string
+	if err := db.QueryRowContext(ctx, "SELECT notes FROM images WHERE id = '1'").Scan(&notes); err != nil {
+		t.Fatal(err)
+	}
+
+	if notes != "edited" {
+		t.Errorf("edit wasn't kept, got notes %q", notes)
+	}
+
+	image, err := provider.Get(ctx, "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if image.Author != "Jane Doe" {
+		t.Errorf("image wasn't updated, got author %s", image.Author)
+	}
+
+	if _, err := provider.Get(ctx, "2"); err != database.ErrNotFound {
+		t.Errorf("removed image wasn't deleted, got error %v", err)
+	}
+
+	list, err := provider.ListAll(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ids(list) != "1,6,10" {
+		t.Errorf("got images %s", ids(list))
+	}
+}
+
+func TestMigrations(t *testing.T) {
+	_, path := newProvider(t)
+
+	// Opening an existing database doesn't apply the migrations again
+	provider, err := sqlite.New(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer provider.Close()
+
+	if _, err := provider.Get(context.Background(), "10"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func ids(images []database.Image) string {
+	result := ""
+	for i, image := range images {
+		if i > 0 {
+			result += ","
+		}
+		result += image.ID
+	}
+
+	return result
+}
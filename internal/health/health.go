@@ -2,6 +2,7 @@ package health
 
 import (
 	"context"
+	"fmt"
 	"sync"
 	"time"
 
@@ -31,6 +32,12 @@ type Status struct {
 	Cache    string `json:"cache,omitempty"`
 	Database string `json:"database,omitempty"`
 	Storage  string `json:"storage,omitempty"`
+	// Whether the cache shared between instances, such as Redis, is reachable
+	// It doesn't affect Healthy, as the cache keeps working using the local fallback, and replacing the instances wouldn't fix it
+	RemoteCache string `json:"remote_cache,omitempty"`
+	// Whether the storage loaded images that didn't match their checksums recently
+	// It doesn't affect Healthy, as corrupt images need to be fixed in the storage rather than by replacing the instance
+	Integrity string `json:"integrity,omitempty"`
 }
 
 // Run starts the health checker
@@ -81,6 +88,9 @@ func (c *Checker) runCheck() {
 		if c.Cache != nil {
 			c.status.Cache = "unknown"
 		}
+		if len(pingers(c.Cache)) > 0 {
+			c.status.RemoteCache = "unknown"
+		}
 		if c.Storage != nil {
 			c.status.Storage = "unknown"
 		}
@@ -119,6 +129,9 @@ func (c *Checker) check(ctx context.Context, channel chan Status) {
 	if c.Cache != nil {
 		status.Cache = "unknown"
 	}
+	if len(pingers(c.Cache)) > 0 {
+		status.RemoteCache = "unknown"
+	}
 	if c.Storage != nil {
 		status.Storage = "unknown"
 	}
@@ -137,12 +150,21 @@ func (c *Checker) check(ctx context.Context, channel chan Status) {
 	}
 
 	if c.Cache != nil {
-		if _, err := c.Cache.Get(ctx, "healthcheck"); err != cache.ErrNotFound {
+		if err := checkCache(ctx, c.Cache); err != nil {
 			status.Healthy = false
 			status.Cache = "unhealthy"
 		} else {
 			status.Cache = "healthy"
 		}
+
+		if remote := pingers(c.Cache); len(remote) > 0 {
+			status.RemoteCache = "healthy"
+			for _, p := range remote {
+				if err := p.Ping(ctx); err != nil {
+					status.RemoteCache = "unhealthy"
+				}
+			}
+		}
 	}
 
 	if ctx.Err() != nil {
@@ -156,7 +178,50 @@ func (c *Checker) check(ctx context.Context, channel chan Status) {
 		} else {
 			status.Storage = "healthy"
 		}
+
+		if checker, ok := c.Storage.(integrityChecker); ok {
+			if err := checker.IntegrityError(); err != nil {
+				status.Integrity = "corrupt"
+			} else {
+				status.Integrity = "ok"
+			}
+		}
 	}
 
 	channel <- status
 }
+
+// pinger is implemented by cache providers that fall back to a local cache while a remote one is unavailable, so Get doesn't tell if the remote cache works
+type pinger interface {
+	Ping(ctx context.Context) error
+}
+
+// pingers returns the caches that can be pinged, including the tiers of a tiered cache
+func pingers(provider cache.Provider) []pinger {
+	if tiered, ok := provider.(*cache.Tiered); ok {
+		var result []pinger
+		for _, tier := range tiered.Providers {
+			result = append(result, pingers(tier)...)
+		}
+		return result
+	}
+
+	if p, ok := provider.(pinger); ok {
+		return []pinger{p}
+	}
+
+	return nil
+}
+
+// integrityChecker is implemented by storage providers that verify the images they load
+type integrityChecker interface {
+	IntegrityError() error
+}
+
+func checkCache(ctx context.Context, provider cache.Provider) error {
+	if _, err := provider.Get(ctx, "healthcheck"); err != cache.ErrNotFound {
+		return fmt.Errorf("unexpected result getting healthcheck key: %v", err)
+	}
+
+	return nil
+}
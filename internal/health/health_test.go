@@ -7,6 +7,7 @@ import (
 
 	"github.com/DMarby/picsum-photos/internal/health"
 	"github.com/DMarby/picsum-photos/internal/logger"
+	"github.com/DMarby/picsum-photos/internal/storage"
 	"go.uber.org/zap"
 
 	fileDatabase "github.com/DMarby/picsum-photos/internal/database/file"
@@ -15,6 +16,7 @@ import (
 	fileStorage "github.com/DMarby/picsum-photos/internal/storage/file"
 	mockStorage "github.com/DMarby/picsum-photos/internal/storage/mock"
 
+	tieredCache "github.com/DMarby/picsum-photos/internal/cache"
 	memoryCache "github.com/DMarby/picsum-photos/internal/cache/memory"
 	mockCache "github.com/DMarby/picsum-photos/internal/cache/mock"
 )
@@ -26,13 +28,22 @@ func TestHealth(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	storage, _ := fileStorage.New("../../test/fixtures/file")
+	fileProvider, _ := fileStorage.New("../../test/fixtures/file")
 	db, _ := fileDatabase.New("../../test/fixtures/file/metadata.json")
-	cache := memoryCache.New()
+	cache := memoryCache.New(1<<20, 0)
 
-	checker := &health.Checker{Ctx: ctx, Storage: storage, Cache: cache, Log: log}
+	checker := &health.Checker{Ctx: ctx, Storage: fileProvider, Cache: cache, Log: log}
 	mockStorageChecker := &health.Checker{Ctx: ctx, Storage: &mockStorage.Provider{}, Cache: cache, Log: log}
-	mockCacheChecker := &health.Checker{Ctx: ctx, Storage: storage, Cache: &mockCache.Provider{}, Log: log}
+	mockCacheChecker := &health.Checker{Ctx: ctx, Storage: fileProvider, Cache: &mockCache.Provider{}, Log: log}
+
+	// The checksum doesn't match the image, so loading it marks the storage as corrupt
+	corruptStorage := &storage.Verified{Provider: fileProvider, Checksums: map[string]string{"1": "invalid"}, SampleRate: 1}
+	corruptStorage.Get(ctx, "1")
+	verifiedChecker := &health.Checker{Ctx: ctx, Storage: &storage.Verified{Provider: fileProvider, SampleRate: 1}, Cache: cache, Log: log}
+	corruptChecker := &health.Checker{Ctx: ctx, Storage: corruptStorage, Cache: cache, Log: log}
+
+	// None of the tiers is a remote cache
+	tieredChecker := &health.Checker{Ctx: ctx, Storage: fileProvider, Cache: &tieredCache.Tiered{Providers: []tieredCache.Provider{cache, memoryCache.New(1<<20, 0)}}, Log: log}
 
 	dbOnlyChecker := &health.Checker{Ctx: ctx, Database: db, Log: log}
 	mockDbOnlyChecker := &health.Checker{Ctx: ctx, Database: &mockDatabase.Provider{}, Log: log}
@@ -69,6 +80,35 @@ func TestHealth(t *testing.T) {
 			},
 			Checker: mockCacheChecker,
 		},
+		{
+			Name: "runs checks and returns correct status with verified storage",
+			ExpectedStatus: health.Status{
+				Healthy:   true,
+				Cache:     "healthy",
+				Storage:   "healthy",
+				Integrity: "ok",
+			},
+			Checker: verifiedChecker,
+		},
+		{
+			Name: "runs checks and returns correct status with corrupt storage",
+			ExpectedStatus: health.Status{
+				Healthy:   true,
+				Cache:     "healthy",
+				Storage:   "healthy",
+				Integrity: "corrupt",
+			},
+			Checker: corruptChecker,
+		},
+		{
+			Name: "doesn't report a remote cache for tiers without one",
+			ExpectedStatus: health.Status{
+				Healthy: true,
+				Cache:   "healthy",
+				Storage: "healthy",
+			},
+			Checker: tieredChecker,
+		},
 		{
 			Name: "runs checks and returns correct status with only a database",
 			ExpectedStatus: health.Status{
@@ -2,6 +2,7 @@ package image
 
 import (
 	"context"
+	"time"
 
 	"github.com/DMarby/picsum-photos/internal/cache"
 	"github.com/DMarby/picsum-photos/internal/storage"
@@ -12,10 +13,13 @@ import (
 type Cache = cache.Auto
 
 // NewCache instantiates a new cache
-func NewCache(tracer *tracing.Tracer, cacheProvider cache.Provider, storageProvider storage.Provider) *Cache {
+// Images that don't exist in the storage are remembered for negativeTTL, and cached images are reloaded from the storage in the background once they're older than maxAge
+func NewCache(tracer *tracing.Tracer, cacheProvider cache.Provider, storageProvider storage.Provider, negativeTTL time.Duration, maxAge time.Duration) *Cache {
 	return &Cache{
-		Tracer:   tracer,
-		Provider: cacheProvider,
+		Tracer:      tracer,
+		Provider:    cacheProvider,
+		NegativeTTL: negativeTTL,
+		MaxAge:      maxAge,
 		Loader: func(ctx context.Context, key string) (data []byte, err error) {
 			ctx, span := tracer.Start(ctx, "image.Cache.Loader")
 			defer span.End()
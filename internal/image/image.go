@@ -2,6 +2,10 @@ package image
 
 import "context"
 
+// ProcessorVersion identifies the output of the image processing pipeline
+// Bump it whenever a change makes the processed images differ, so that clients revalidating cached images fetch them again
+const ProcessorVersion = "1"
+
 // Processor is an image processor
 type Processor interface {
 	ProcessImage(ctx context.Context, task *Task) (processedImage []byte, err error)
@@ -1,5 +1,10 @@
 package image
 
+import (
+	"fmt"
+	"math"
+)
+
 // Task is an image processing task
 type Task struct {
 	ImageID        string
@@ -45,3 +50,17 @@ func (t *Task) Grayscale() *Task {
 	t.ApplyGrayscale = true
 	return t
 }
+
+// SourceKey returns the key of the source image to process the task from
+// We use a pre-processed source image closer to the desired size then the original,
+// at 2x the requested size to maintain quality when downscaling
+func (t *Task) SourceKey() string {
+	width := math.Ceil(float64(t.Width*2)/500) * 500
+	height := math.Ceil(float64(t.Height*2)/500) * 500
+	size := math.Max(width, height)
+	if size <= 4500 { // Files larger then 4500 doesn't have a suffix
+		return fmt.Sprintf("%s_%0.f", t.ImageID, size)
+	}
+
+	return t.ImageID
+}
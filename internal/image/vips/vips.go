@@ -84,66 +84,68 @@ func taskProcessor(cache *image.Cache, tracer *tracing.Tracer) func(ctx context.
 			return nil, fmt.Errorf("invalid data")
 		}
 
-		// Use a pre-processed source image closer to the desired size then the original
-		// We use 2x the requested size to maintain quality when downscaling
-		imageKey := task.ImageID
-		width := math.Ceil(float64(task.Width*2)/500) * 500
-		height := math.Ceil(float64(task.Height*2)/500) * 500
-		size := math.Max(width, height)
-		if size <= 4500 { // Files larger then 4500 doesn't have a suffix
-			imageKey = fmt.Sprintf("%s_%0.f", task.ImageID, size)
-		}
-
-		imageBuffer, err := cache.Get(ctx, imageKey)
+		imageBuffer, err := cache.Get(ctx, task.SourceKey())
 		if err != nil {
 			return nil, fmt.Errorf("error getting image from cache: %s", err)
 		}
 
-		_, span := tracer.Start(ctx, "image.resizeImage")
-		processedImage, err := resizeImage(imageBuffer, task.Width, task.Height)
-		span.End()
-		if err != nil {
-			return nil, err
-		}
+		return Transform(ctx, tracer, task, imageBuffer)
+	}
+}
 
-		if task.ApplyBlur {
-			_, span := tracer.Start(ctx, "image.blur")
-			processedImage, err = processedImage.blur(task.BlurAmount)
-			span.End()
-			if err != nil {
-				return nil, err
-			}
-		}
+// Initialize initializes vips for use with Transform
+// It's called automatically by New
+func Initialize(log *logger.Logger) error {
+	return vips.Initialize(log)
+}
 
-		if task.ApplyGrayscale {
-			_, span := tracer.Start(ctx, "image.grayscale")
-			processedImage, err = processedImage.grayscale()
-			span.End()
-			if err != nil {
-				return nil, err
-			}
-		}
+// Transform processes the source image in the buffer according to the task, and returns a buffer containing the processed image
+// Note that it does not use the processor worker queue, use ProcessImage for that
+func Transform(ctx context.Context, tracer *tracing.Tracer, task *image.Task, imageBuffer []byte) ([]byte, error) {
+	_, span := tracer.Start(ctx, "image.resizeImage")
+	processedImage, err := resizeImage(imageBuffer, task.Width, task.Height)
+	span.End()
+	if err != nil {
+		return nil, err
+	}
 
-		processedImage.setUserComment(task.UserComment)
-
-		var buffer []byte
-		switch task.OutputFormat {
-		case image.JPEG:
-			_, span := tracer.Start(ctx, "image.saveToJpegBuffer")
-			buffer, err = processedImage.saveToJpegBuffer()
-			span.End()
-		case image.WebP:
-			_, span := tracer.Start(ctx, "image.saveToWebPBuffer")
-			buffer, err = processedImage.saveToWebPBuffer()
-			span.End()
+	if task.ApplyBlur {
+		_, span := tracer.Start(ctx, "image.blur")
+		processedImage, err = processedImage.blur(task.BlurAmount)
+		span.End()
+		if err != nil {
+			return nil, err
 		}
+	}
 
+	if task.ApplyGrayscale {
+		_, span := tracer.Start(ctx, "image.grayscale")
+		processedImage, err = processedImage.grayscale()
+		span.End()
 		if err != nil {
 			return nil, err
 		}
+	}
+
+	processedImage.setUserComment(task.UserComment)
 
-		return buffer, nil
+	var buffer []byte
+	switch task.OutputFormat {
+	case image.JPEG:
+		_, span := tracer.Start(ctx, "image.saveToJpegBuffer")
+		buffer, err = processedImage.saveToJpegBuffer()
+		span.End()
+	case image.WebP:
+		_, span := tracer.Start(ctx, "image.saveToWebPBuffer")
+		buffer, err = processedImage.saveToWebPBuffer()
+		span.End()
 	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return buffer, nil
 }
 
 // Shutdown shuts down the image processor and deinitialises vips
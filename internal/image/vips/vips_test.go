@@ -115,7 +115,7 @@ func setup() (context.CancelFunc, *vips.Processor, []byte, error) {
 		return nil, nil, nil, err
 	}
 
-	cache := image.NewCache(tracer, memory.New(), storage)
+	cache := image.NewCache(tracer, memory.New(64<<20, 0), storage, 0, 0)
 
 	processor, err := vips.New(ctx, log, tracer, 3, cache)
 	if err != nil {
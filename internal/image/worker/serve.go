@@ -0,0 +1,77 @@
+package worker
+
+import (
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"runtime/debug"
+	"syscall"
+
+	"github.com/DMarby/picsum-photos/internal/image"
+)
+
+// File descriptors of the pipes passed to worker processes, following stdin, stdout and stderr
+const (
+	requestFd  = 3
+	responseFd = 4
+)
+
+// ProcessFunc processes the source image in the buffer according to the task
+type ProcessFunc func(task *image.Task, buffer []byte) ([]byte, error)
+
+// Serve runs the worker side of the worker process protocol, processing tasks until the parent process goes away
+// It's meant to be called from the command that's given to New
+func Serve(processFunc ProcessFunc) error {
+	requests := os.NewFile(requestFd, "requests")
+	responses := os.NewFile(responseFd, "responses")
+	if requests == nil || responses == nil {
+		return fmt.Errorf("missing worker pipes")
+	}
+	defer requests.Close()
+	defer responses.Close()
+
+	decoder := gob.NewDecoder(requests)
+	encoder := gob.NewEncoder(responses)
+
+	for {
+		var req request
+		if err := decoder.Decode(&req); err != nil {
+			// The parent process closed the pipe, shut down
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+
+			return err
+		}
+
+		var res response
+		processedImage, err := processFunc(&req.Task, req.Buffer)
+		if err != nil {
+			res.Err = err.Error()
+		} else {
+			res.Image = processedImage
+		}
+
+		if err := encoder.Encode(&res); err != nil {
+			return err
+		}
+	}
+}
+
+// LimitMemory limits the memory of the current process to the given amount of bytes
+// Allocations past the limit fail, which crashes the worker process and causes it to be restarted
+func LimitMemory(limit int64) error {
+	if limit <= 0 {
+		return nil
+	}
+
+	// Have the Go runtime try to keep below the limit before we hit the hard limit
+	debug.SetMemoryLimit(limit)
+
+	return syscall.Setrlimit(syscall.RLIMIT_DATA, &syscall.Rlimit{
+		Cur: uint64(limit),
+		Max: uint64(limit),
+	})
+}
@@ -0,0 +1,286 @@
+package worker
+
+import (
+	"context"
+	"encoding/gob"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"time"
+
+	"github.com/DMarby/picsum-photos/internal/image"
+	"github.com/DMarby/picsum-photos/internal/logger"
+	"github.com/DMarby/picsum-photos/internal/queue"
+	"github.com/DMarby/picsum-photos/internal/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// How long a worker process gets to process a task before it's considered hung and killed
+const taskTimeout = 30 * time.Second
+
+var (
+	workerProcesses = expvar.NewInt("gauge_image_worker_processes")
+	workerRestarts  = expvar.NewInt("counter_image_worker_restarts")
+	taskRetries     = expvar.NewInt("counter_image_worker_task_retries")
+)
+
+// errCrashed is returned when a worker process exits or stops responding while processing a task
+var errCrashed = errors.New("worker process crashed")
+
+// Processor is an image processor that sends tasks to a pool of worker processes,
+// so that crashes in the image processing don't take down the whole service
+type Processor struct {
+	queue  *queue.Queue
+	tracer *tracing.Tracer
+}
+
+// request is a task sent to a worker process
+type request struct {
+	Task   image.Task
+	Buffer []byte
+}
+
+// response is the result of a task, sent back from a worker process
+type response struct {
+	Image []byte
+	Err   string
+}
+
+// process is a worker process
+type process struct {
+	command []string
+	log     *logger.Logger
+
+	cmd     *exec.Cmd
+	encoder *gob.Encoder
+	decoder *gob.Decoder
+	closers []io.Closer
+	exited  chan struct{}
+}
+
+// New starts a pool of worker processes using the given command, which should run Serve
+func New(ctx context.Context, log *logger.Logger, tracer *tracing.Tracer, workers int, command []string, cache *image.Cache) (*Processor, error) {
+	processes := make(chan *process, workers)
+	for i := 0; i < workers; i++ {
+		p := &process{
+			command: command,
+			log:     log,
+		}
+
+		if err := p.start(); err != nil {
+			close(processes)
+			for p := range processes {
+				p.stop()
+			}
+
+			return nil, err
+		}
+
+		processes <- p
+	}
+
+	workerQueue := queue.New(ctx, workers, taskProcessor(cache, processes))
+	instance := &Processor{
+		queue:  workerQueue,
+		tracer: tracer,
+	}
+
+	// Publish queue size metric (only if not already registered)
+	if expvar.Get("gauge_image_processor_queue_size") == nil {
+		expvar.Publish("gauge_image_processor_queue_size", expvar.Func(func() any {
+			return workerQueue.Len()
+		}))
+	}
+
+	go workerQueue.Run()
+	go func() {
+		<-ctx.Done()
+		for i := 0; i < workers; i++ {
+			p := <-processes
+			p.stop()
+		}
+	}()
+
+	log.Infof("starting image worker queue with %d worker processes", workers)
+
+	return instance, nil
+}
+
+// ProcessImage loads an image from a byte buffer, processes it in a worker process, and returns a buffer containing the processed image
+func (p *Processor) ProcessImage(ctx context.Context, task *image.Task) (processedImage []byte, err error) {
+	ctx, span := p.tracer.Start(
+		ctx,
+		"image.ProcessImage",
+		trace.WithAttributes(attribute.Int("width", task.Width)),
+		trace.WithAttributes(attribute.Int("height", task.Height)),
+		trace.WithAttributes(attribute.Int("format", int(task.OutputFormat))),
+	)
+	defer span.End()
+
+	result, err := p.queue.Process(ctx, task)
+	if err != nil {
+		return nil, err
+	}
+
+	image, ok := result.([]byte)
+	if !ok {
+		return nil, fmt.Errorf("error getting result")
+	}
+
+	return image, nil
+}
+
+func taskProcessor(cache *image.Cache, processes chan *process) func(ctx context.Context, data interface{}) (interface{}, error) {
+	return func(ctx context.Context, data interface{}) (interface{}, error) {
+		task, ok := data.(*image.Task)
+		if !ok {
+			return nil, fmt.Errorf("invalid data")
+		}
+
+		imageBuffer, err := cache.Get(ctx, task.SourceKey())
+		if err != nil {
+			return nil, fmt.Errorf("error getting image from cache: %s", err)
+		}
+
+		// There's one process per queue worker, so there's always one available
+		p := <-processes
+		defer func() {
+			processes <- p
+		}()
+
+		// If the process crashes we restart it and retry the task once, in case it was a one-off
+		result, err := p.process(task, imageBuffer)
+		if errors.Is(err, errCrashed) {
+			taskRetries.Add(1)
+			result, err = p.process(task, imageBuffer)
+		}
+
+		return result, err
+	}
+}
+
+// start starts the worker process, connecting to it with a pair of pipes
+func (p *process) start() error {
+	// The pipes are passed as extra file descriptors, as the worker process logs to stdout and stderr
+	requestReader, requestWriter, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+
+	responseReader, responseWriter, err := os.Pipe()
+	if err != nil {
+		requestReader.Close()
+		requestWriter.Close()
+		return err
+	}
+
+	cmd := exec.Command(p.command[0], p.command[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = []*os.File{requestReader, responseWriter}
+
+	err = cmd.Start()
+
+	// The child process has its own copies of its ends of the pipes
+	requestReader.Close()
+	responseWriter.Close()
+
+	if err != nil {
+		requestWriter.Close()
+		responseReader.Close()
+		return fmt.Errorf("error starting worker process: %w", err)
+	}
+
+	exited := make(chan struct{})
+	go func() {
+		cmd.Wait()
+		close(exited)
+	}()
+
+	p.cmd = cmd
+	p.encoder = gob.NewEncoder(requestWriter)
+	p.decoder = gob.NewDecoder(responseReader)
+	p.closers = []io.Closer{requestWriter, responseReader}
+	p.exited = exited
+	workerProcesses.Add(1)
+
+	return nil
+}
+
+// stop kills the worker process
+func (p *process) stop() {
+	if p.cmd == nil {
+		return
+	}
+
+	for _, closer := range p.closers {
+		closer.Close()
+	}
+
+	p.cmd.Process.Kill()
+	<-p.exited
+
+	p.cmd = nil
+	workerProcesses.Add(-1)
+}
+
+// process sends a task to the worker process and waits for the result
+// If the worker process has crashed, it's restarted before the task is sent
+func (p *process) process(task *image.Task, buffer []byte) ([]byte, error) {
+	if p.cmd == nil {
+		workerRestarts.Add(1)
+		if err := p.start(); err != nil {
+			return nil, err
+		}
+	}
+
+	var (
+		res  response
+		err  error
+		done = make(chan struct{})
+	)
+
+	go func() {
+		err = p.encoder.Encode(&request{Task: *task, Buffer: buffer})
+		if err == nil {
+			err = p.decoder.Decode(&res)
+		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-p.exited:
+		// Give the pipes a moment to drain, in case the process exited right after responding
+		select {
+		case <-done:
+		case <-time.After(100 * time.Millisecond):
+		}
+	case <-time.After(taskTimeout):
+		p.log.Errorw("worker process timed out, killing it", "pid", p.cmd.Process.Pid)
+	}
+
+	select {
+	case <-done:
+		if err == nil {
+			if res.Err != "" {
+				return nil, errors.New(res.Err)
+			}
+
+			return res.Image, nil
+		}
+	default:
+	}
+
+	// The process crashed or hung, kill it so that it's restarted for the next task
+	pid := p.cmd.Process.Pid
+	p.stop()
+	<-done
+	p.log.Errorw("worker process crashed", "pid", pid, "error", err)
+
+	return nil, errCrashed
+}
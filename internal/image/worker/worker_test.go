@@ -0,0 +1,130 @@
+package worker_test
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/DMarby/picsum-photos/internal/cache"
+	"github.com/DMarby/picsum-photos/internal/cache/memory"
+	"github.com/DMarby/picsum-photos/internal/image"
+	"github.com/DMarby/picsum-photos/internal/image/worker"
+	"github.com/DMarby/picsum-photos/internal/logger"
+	"github.com/DMarby/picsum-photos/internal/tracing/test"
+	"go.uber.org/zap"
+)
+
+// TestMain runs the test binary as a worker process when it's started by the processor
+func TestMain(m *testing.M) {
+	if os.Getenv("PICSUM_TEST_WORKER") == "1" {
+		if err := worker.Serve(process); err != nil {
+			os.Exit(1)
+		}
+
+		os.Exit(0)
+	}
+
+	os.Exit(m.Run())
+}
+
+// process is a fake image processor that echoes the task, and crashes on demand
+func process(task *image.Task, buffer []byte) ([]byte, error) {
+	switch task.UserComment {
+	case "crash":
+		os.Exit(2)
+	case "error":
+		return nil, fmt.Errorf("processing error")
+	default:
+		// Crash the first time we see the marker file
+		if strings.HasPrefix(task.UserComment, "crashonce:") {
+			marker := strings.TrimPrefix(task.UserComment, "crashonce:")
+			if _, err := os.Stat(marker); err != nil {
+				os.WriteFile(marker, nil, 0644)
+				os.Exit(2)
+			}
+		}
+	}
+
+	return []byte(fmt.Sprintf("%s-%dx%d:%s", task.ImageID, task.Width, task.Height, buffer)), nil
+}
+
+func TestWorker(t *testing.T) {
+	t.Setenv("PICSUM_TEST_WORKER", "1")
+
+	log := logger.New(zap.FatalLevel)
+	defer log.Sync()
+
+	tracer := test.Tracer(log)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	imageCache := &image.Cache{
+		Tracer:   tracer,
+		Provider: memory.New(1<<20, 0),
+		Loader: func(ctx context.Context, key string) (data []byte, err error) {
+			if key == "notfound_500" {
+				return nil, cache.ErrNotFound
+			}
+
+			return []byte(key), nil
+		},
+	}
+
+	processor, err := worker.New(ctx, log, tracer, 2, []string{os.Args[0], "-test.run=^$"}, imageCache)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("process image", func(t *testing.T) {
+		buf, err := processor.ProcessImage(context.Background(), image.NewTask("1", 200, 100, "testing", image.JPEG))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(buf) != "1-200x100:1_500" {
+			t.Fatalf("wrong result %s", buf)
+		}
+	})
+
+	t.Run("process image handles errors", func(t *testing.T) {
+		_, err := processor.ProcessImage(context.Background(), image.NewTask("1", 200, 100, "error", image.JPEG))
+		if err == nil || err.Error() != "processing error" {
+			t.Fatalf("wrong error %s", err)
+		}
+
+		_, err = processor.ProcessImage(context.Background(), image.NewTask("notfound", 200, 100, "testing", image.JPEG))
+		if err == nil || err.Error() != "error getting image from cache: not found in cache" {
+			t.Fatalf("wrong error %s", err)
+		}
+	})
+
+	t.Run("retries once after a crash", func(t *testing.T) {
+		marker := filepath.Join(t.TempDir(), "marker")
+		buf, err := processor.ProcessImage(context.Background(), image.NewTask("1", 200, 100, "crashonce:"+marker, image.JPEG))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(buf) != "1-200x100:1_500" {
+			t.Fatalf("wrong result %s", buf)
+		}
+	})
+
+	t.Run("returns an error after crashing twice", func(t *testing.T) {
+		_, err := processor.ProcessImage(context.Background(), image.NewTask("1", 200, 100, "crash", image.JPEG))
+		if err == nil || err.Error() != "worker process crashed" {
+			t.Fatalf("wrong error %s", err)
+		}
+
+		// The crashed worker processes are restarted
+		for i := 0; i < 4; i++ {
+			if _, err := processor.ProcessImage(context.Background(), image.NewTask("1", 200, 100, "testing", image.JPEG)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	})
+}
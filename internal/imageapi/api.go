@@ -2,14 +2,18 @@ package imageapi
 
 import (
 	"expvar"
+	"net"
 	"net/http"
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/DMarby/picsum-photos/internal/cache"
 	"github.com/DMarby/picsum-photos/internal/handler"
 	"github.com/DMarby/picsum-photos/internal/hmac"
+	"github.com/DMarby/picsum-photos/internal/lru"
+	"github.com/DMarby/picsum-photos/internal/peers"
 	"github.com/DMarby/picsum-photos/internal/tracing"
-	"github.com/hashicorp/golang-lru/v2/expirable"
 	"github.com/rs/cors"
 
 	"github.com/DMarby/picsum-photos/internal/image"
@@ -17,11 +21,6 @@ import (
 	"github.com/gorilla/mux"
 )
 
-const (
-	imageCacheTTL      = 10 * time.Minute
-	imageCacheCapacity = 150_000
-)
-
 // API is a http api
 type API struct {
 	ImageProcessor image.Processor
@@ -29,19 +28,39 @@ type API struct {
 	Tracer         *tracing.Tracer
 	HandlerTimeout time.Duration
 	HMAC           *hmac.HMAC
-	imageCache     *expirable.LRU[string, []byte] // caches processed images
-	inflight       sync.Map                       // map[string]chan struct{} - coalesces concurrent requests
+	ClientIPHeader string         // header containing the client ip when running behind a proxy, used for fair queuing
+	DiskCache      cache.Provider // optional second tier cache for processed images, that survives restarts
+	Peers          *peers.Pool    // optional pool of instances to share processed images with
+	imageCache     *lru.Cache     // caches processed images
+	variants       *variantIndex  // tracks the cached sizes of each image, for degrading when overloaded
+	inflight       sync.Map       // map[string]*call - coalesces concurrent requests
 }
 
 // NewAPI creates a new API instance with initialized caches
-func NewAPI(imageProcessor image.Processor, log *logger.Logger, tracer *tracing.Tracer, handlerTimeout time.Duration, hmac *hmac.HMAC) *API {
-	cache := expirable.NewLRU[string, []byte](imageCacheCapacity, nil, imageCacheTTL)
+// The processed image cache holds up to cacheSize bytes of images, for up to cacheTTL
+func NewAPI(imageProcessor image.Processor, log *logger.Logger, tracer *tracing.Tracer, handlerTimeout time.Duration, hmac *hmac.HMAC, cacheSize int64, cacheTTL time.Duration) *API {
+	variants := newVariantIndex()
+	cache := lru.New(cacheSize, cacheTTL, func(key string, _ []byte) {
+		variants.remove(key)
+	})
 
-	// Publish cache size gauge metric (only if not already registered)
+	// Publish cache metrics (only if not already registered)
 	if expvar.Get("gauge_imageapi_cache_size") == nil {
 		expvar.Publish("gauge_imageapi_cache_size", expvar.Func(func() any {
 			return cache.Len()
 		}))
+		expvar.Publish("gauge_imageapi_cache_bytes", expvar.Func(func() any {
+			return cache.Stats().Bytes
+		}))
+		expvar.Publish("counter_imageapi_cache_evictions", expvar.Func(func() any {
+			return cache.Stats().Evictions
+		}))
+		expvar.Publish("counter_imageapi_cache_expirations", expvar.Func(func() any {
+			return cache.Stats().Expirations
+		}))
+		expvar.Publish("gauge_imageapi_cache_hit_ratio", expvar.Func(func() any {
+			return cache.Stats().HitRatio()
+		}))
 	}
 
 	return &API{
@@ -51,6 +70,7 @@ func NewAPI(imageProcessor image.Processor, log *logger.Logger, tracer *tracing.
 		HandlerTimeout: handlerTimeout,
 		HMAC:           hmac,
 		imageCache:     cache,
+		variants:       variants,
 	}
 }
 
@@ -59,6 +79,34 @@ func (a *API) logError(r *http.Request, message string, err error) {
 	a.Log.Errorw(message, handler.LogFields(r, "error", err)...)
 }
 
+// clientID returns the identity of the client making the request, used to share the processing queue fairly between clients
+func (a *API) clientID(r *http.Request) string {
+	// Requests forwarded by a peer are attributed to the client that made the original request
+	if a.Peers != nil {
+		if clientID, ok := a.Peers.Client(r); ok {
+			return clientID
+		}
+	}
+
+	if a.ClientIPHeader != "" {
+		if value := r.Header.Get(a.ClientIPHeader); value != "" {
+			// Proxies append the address they received the request from to headers such as X-Forwarded-For,
+			// so the last entry is the only one that wasn't sent by the client
+			if i := strings.LastIndex(value, ","); i >= 0 {
+				value = value[i+1:]
+			}
+			return strings.TrimSpace(value)
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return host
+}
+
 // Router returns a http router
 func (a *API) Router() http.Handler {
 	router := mux.NewRouter()
@@ -69,7 +117,7 @@ func (a *API) Router() http.Handler {
 	router.StrictSlash(true)
 
 	// Image by ID routes
-	router.Handle("/id/{id}/{width:[0-9]+}/{height:[0-9]+}{extension:\\..*}", handler.Handler(a.imageHandler)).Methods("GET").Name("imageapi.image")
+	router.Handle("/id/{id}/{width:[0-9]+}/{height:[0-9]+}{extension:\\..*}", handler.Handler(a.imageHandler)).Methods("GET", "HEAD").Name("imageapi.image")
 
 	// Query parameters:
 	// ?grayscale - Grayscale the image
@@ -79,9 +127,9 @@ func (a *API) Router() http.Handler {
 
 	// Set up handlers
 	cors := cors.New(cors.Options{
-		AllowedMethods: []string{"GET"},
+		AllowedMethods: []string{"GET", "HEAD"},
 		AllowedOrigins: []string{"*"},
-		ExposedHeaders: []string{"Content-Type", "Picsum-ID"},
+		ExposedHeaders: []string{"Content-Type", "Content-Length", "Content-Range", "Accept-Ranges", "ETag", "Picsum-ID", "Picsum-Degraded"},
 	})
 
 	httpHandler := cors.Handler(router)
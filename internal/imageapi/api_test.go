@@ -2,20 +2,26 @@ package imageapi_test
 
 import (
 	"context"
+	"expvar"
 	"fmt"
+	"io"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"os"
 	"reflect"
 	"runtime"
+	"sync/atomic"
 	"time"
 
+	"github.com/DMarby/picsum-photos/internal/cache/disk"
 	"github.com/DMarby/picsum-photos/internal/hmac"
 	"github.com/DMarby/picsum-photos/internal/image"
 	api "github.com/DMarby/picsum-photos/internal/imageapi"
 	"github.com/DMarby/picsum-photos/internal/logger"
 	"github.com/DMarby/picsum-photos/internal/params"
+	"github.com/DMarby/picsum-photos/internal/peers"
+	"github.com/DMarby/picsum-photos/internal/queue"
 	"github.com/DMarby/picsum-photos/internal/tracing"
 	"github.com/DMarby/picsum-photos/internal/tracing/test"
 	"go.uber.org/zap"
@@ -31,17 +37,22 @@ import (
 	"testing"
 )
 
+const (
+	cacheSize = 64 << 20
+	cacheTTL  = time.Minute
+)
+
 func TestAPI(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
 	log, tracer, imageProcessor, hmac := setup(t, ctx)
 
-	mockStorageImageProcessor, _ := vipsProcessor.New(ctx, log, tracer, 3, image.NewCache(tracer, memoryCache.New(), &mockStorage.Provider{}))
+	mockStorageImageProcessor, _ := vipsProcessor.New(ctx, log, tracer, 3, image.NewCache(tracer, memoryCache.New(cacheSize, 0), &mockStorage.Provider{}, 0, 0))
 
-	router := api.NewAPI(imageProcessor, log, tracer, time.Minute, hmac).Router()
-	mockStorageRouter := api.NewAPI(mockStorageImageProcessor, log, tracer, time.Minute, hmac).Router()
-	mockProcessorRouter := api.NewAPI(&mockProcessor.Processor{}, log, tracer, time.Minute, hmac).Router()
+	router := newTestAPI(t, imageProcessor, nil).handler
+	mockStorageRouter := newTestAPI(t, mockStorageImageProcessor, nil).handler
+	mockProcessorRouter := newTestAPI(t, &mockProcessor.Processor{}, nil).handler
 
 	tests := []struct {
 		Name             string
@@ -186,6 +197,599 @@ func TestAPI(t *testing.T) {
 	}
 }
 
+// overloadedProcessor is an image processor that can be toggled to act as if its queue is full
+type overloadedProcessor struct {
+	overloaded atomic.Bool
+	processed  atomic.Int64
+}
+
+func (p *overloadedProcessor) ProcessImage(ctx context.Context, task *image.Task) ([]byte, error) {
+	if p.overloaded.Load() {
+		return nil, queue.ErrQueueFull
+	}
+
+	p.processed.Add(1)
+
+	return []byte(fmt.Sprintf("%s-%dx%d", task.ImageID, task.Width, task.Height)), nil
+}
+
+func TestOverloaded(t *testing.T) {
+	processor := &overloadedProcessor{}
+	a := newTestAPI(t, processor, nil)
+	get := a.get
+
+	if w := get("/id/1/200/100.jpg"); w.Code != http.StatusOK {
+		t.Fatalf("wrong response code, %#v", w.Code)
+	}
+
+	processor.overloaded.Store(true)
+
+	t.Run("serves a nearby size", func(t *testing.T) {
+		w := get("/id/1/300/150.jpg")
+		if w.Code != http.StatusOK {
+			t.Fatalf("wrong response code, %#v", w.Code)
+		}
+
+		if body := w.Body.String(); body != "1-200x100" {
+			t.Errorf("wrong response %#v", body)
+		}
+
+		if degraded := w.Header().Get("Picsum-Degraded"); degraded != "true" {
+			t.Errorf("wrong degraded header, %#v", degraded)
+		}
+
+		if cacheControl := w.Header().Get("Cache-Control"); cacheControl != "public, max-age=60" {
+			t.Errorf("wrong cache header, %#v", cacheControl)
+		}
+
+		if contentDisposition := w.Header().Get("Content-Disposition"); contentDisposition != "inline; filename=\"1-200x100.jpg\"" {
+			t.Errorf("wrong content disposition header, %#v", contentDisposition)
+		}
+	})
+
+	t.Run("doesn't serve sizes that are much smaller or larger", func(t *testing.T) {
+		for _, path := range []string{"/id/1/100/50.jpg", "/id/1/500/250.jpg"} {
+			w := get(path)
+			if w.Code != http.StatusServiceUnavailable {
+				t.Errorf("%s: wrong response code, %#v", path, w.Code)
+			}
+
+			if degraded := w.Header().Get("Picsum-Degraded"); degraded != "" {
+				t.Errorf("%s: wrong degraded header, %#v", path, degraded)
+			}
+		}
+	})
+
+	t.Run("serves the largest size that's no larger than the requested one", func(t *testing.T) {
+		processor.overloaded.Store(false)
+		for _, path := range []string{"/id/1/240/120.jpg", "/id/1/400/200.jpg"} {
+			if w := get(path); w.Code != http.StatusOK {
+				t.Fatalf("%s: wrong response code, %#v", path, w.Code)
+			}
+		}
+		processor.overloaded.Store(true)
+
+		w := get("/id/1/300/150.jpg")
+		if body := w.Body.String(); body != "1-240x120" {
+			t.Errorf("wrong response %#v", body)
+		}
+	})
+
+	t.Run("asks the client to retry later", func(t *testing.T) {
+		// Different aspect ratio, format and image
+		for _, path := range []string{"/id/1/100/100.jpg", "/id/1/300/150.webp", "/id/2/300/150.jpg"} {
+			w := get(path)
+			if w.Code != http.StatusServiceUnavailable {
+				t.Errorf("%s: wrong response code, %#v", path, w.Code)
+			}
+
+			if retryAfter := w.Header().Get("Retry-After"); retryAfter != "5" {
+				t.Errorf("%s: wrong retry after header, %#v", path, retryAfter)
+			}
+		}
+	})
+}
+
+func TestConditional(t *testing.T) {
+	processor := &overloadedProcessor{}
+	a := newTestAPI(t, processor, nil)
+
+	get := func(path string, ifNoneMatch string) *httptest.ResponseRecorder {
+		t.Helper()
+
+		header := map[string]string{}
+		if ifNoneMatch != "" {
+			header["If-None-Match"] = ifNoneMatch
+		}
+
+		return a.request(context.Background(), "GET", path, header)
+	}
+
+	w := get("/id/1/200/100.jpg", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("wrong response code, %#v", w.Code)
+	}
+
+	etag := w.Header().Get("ETag")
+	if etag == "" || etag[0] != '"' {
+		t.Fatalf("wrong etag, %#v", etag)
+	}
+
+	if other := get("/id/1/200/100.webp", "").Header().Get("ETag"); other == etag {
+		t.Errorf("different images have the same etag")
+	}
+
+	// Revalidation shouldn't require processing the image, even if it's no longer cached
+	processor.overloaded.Store(true)
+
+	for _, ifNoneMatch := range []string{etag, "W/" + etag, `"foo", ` + etag, "*"} {
+		w := get("/id/1/200/100.jpg", ifNoneMatch)
+		if w.Code != http.StatusNotModified {
+			t.Errorf("%s: wrong response code, %#v", ifNoneMatch, w.Code)
+		}
+
+		if w.Body.Len() != 0 {
+			t.Errorf("%s: unexpected body", ifNoneMatch)
+		}
+
+		if w.Header().Get("ETag") != etag {
+			t.Errorf("%s: wrong etag, %#v", ifNoneMatch, w.Header().Get("ETag"))
+		}
+	}
+
+	if w := get("/id/1/200/100.jpg", `"foo"`); w.Code != http.StatusOK {
+		t.Errorf("wrong response code for a mismatching etag, %#v", w.Code)
+	}
+
+	// Any etag only matches images that exist
+	if w := get("/id/2/200/100.jpg", "*"); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("wrong response code for an image we don't have, %#v", w.Code)
+	}
+}
+
+func TestHeadAndRange(t *testing.T) {
+	processor := &overloadedProcessor{}
+	a := newTestAPI(t, processor, nil)
+
+	request := func(method string, path string, header map[string]string) *httptest.ResponseRecorder {
+		t.Helper()
+
+		return a.request(context.Background(), method, path, header)
+	}
+
+	t.Run("head", func(t *testing.T) {
+		w := request("HEAD", "/id/1/200/100.jpg", nil)
+		if w.Code != http.StatusOK {
+			t.Fatalf("wrong response code, %#v", w.Code)
+		}
+
+		if w.Body.Len() != 0 {
+			t.Errorf("unexpected body %#v", w.Body.String())
+		}
+
+		if contentLength := w.Header().Get("Content-Length"); contentLength != "9" {
+			t.Errorf("wrong content length, %#v", contentLength)
+		}
+
+		if contentType := w.Header().Get("Content-Type"); contentType != "image/jpeg" {
+			t.Errorf("wrong content type, %#v", contentType)
+		}
+
+		// The image is cached now, so it's not processed again
+		request("HEAD", "/id/1/200/100.jpg", nil)
+		if processed := processor.processed.Load(); processed != 1 {
+			t.Errorf("image was processed %d times", processed)
+		}
+	})
+
+	t.Run("range", func(t *testing.T) {
+		w := request("GET", "/id/1/200/100.jpg", map[string]string{"Range": "bytes=2-4"})
+		if w.Code != http.StatusPartialContent {
+			t.Fatalf("wrong response code, %#v", w.Code)
+		}
+
+		if body := w.Body.String(); body != "200" {
+			t.Errorf("wrong response %#v", body)
+		}
+
+		if contentRange := w.Header().Get("Content-Range"); contentRange != "bytes 2-4/9" {
+			t.Errorf("wrong content range, %#v", contentRange)
+		}
+	})
+
+	t.Run("range with a stale if-range", func(t *testing.T) {
+		w := request("GET", "/id/1/200/100.jpg", map[string]string{"Range": "bytes=2-4", "If-Range": `"stale"`})
+		if w.Code != http.StatusOK {
+			t.Fatalf("wrong response code, %#v", w.Code)
+		}
+
+		if body := w.Body.String(); body != "1-200x100" {
+			t.Errorf("wrong response %#v", body)
+		}
+	})
+
+	t.Run("unsatisfiable range", func(t *testing.T) {
+		w := request("GET", "/id/1/200/100.jpg", map[string]string{"Range": "bytes=100-"})
+		if w.Code != http.StatusRequestedRangeNotSatisfiable {
+			t.Fatalf("wrong response code, %#v", w.Code)
+		}
+	})
+}
+
+func TestPurge(t *testing.T) {
+	ctx := context.Background()
+	diskCache, err := disk.New("test", t.TempDir(), cacheSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	processor := &overloadedProcessor{}
+	a := newTestAPI(t, processor, func(a *api.API) {
+		a.DiskCache = diskCache
+	})
+
+	a.get("/id/1/200/100.jpg")
+
+	keys, err := a.Keys(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key := "1-200x100.jpg-v" + image.ProcessorVersion
+	if !reflect.DeepEqual(keys, []string{key}) {
+		t.Fatalf("wrong keys %#v", keys)
+	}
+
+	// Both the image cache and the disk cache hold a copy
+	freed, err := a.Delete(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if freed != 18 {
+		t.Errorf("wrong amount freed %d", freed)
+	}
+
+	processor.overloaded.Store(true)
+
+	if w := a.get("/id/1/200/100.jpg"); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("purged image was served, %#v", w.Code)
+	}
+}
+
+// blockingProcessor is an image processor that blocks until it's told how to finish
+type blockingProcessor struct {
+	calls   atomic.Int64
+	started chan struct{}
+	release chan error
+}
+
+func (p *blockingProcessor) ProcessImage(ctx context.Context, task *image.Task) ([]byte, error) {
+	p.calls.Add(1)
+	p.started <- struct{}{}
+
+	select {
+	case err := <-p.release:
+		if err != nil {
+			return nil, err
+		}
+
+		return []byte("image"), nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func TestCoalescing(t *testing.T) {
+	setup := func() (*testAPI, *blockingProcessor) {
+		processor := &blockingProcessor{
+			started: make(chan struct{}, 10),
+			release: make(chan error),
+		}
+
+		return newTestAPI(t, processor, nil), processor
+	}
+
+	// request makes a request in the background, returning a channel with the response
+	request := func(ctx context.Context, a *testAPI) chan *httptest.ResponseRecorder {
+		url := a.url("/id/1/200/100.jpg")
+
+		result := make(chan *httptest.ResponseRecorder, 1)
+		go func() {
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequestWithContext(ctx, "GET", url, nil)
+			a.handler.ServeHTTP(w, req)
+			result <- w
+		}()
+
+		return result
+	}
+
+	// waitForCoalesced waits until n more requests are waiting for the in-flight request
+	coalesced := expvar.Get("counter_imageapi_requests_coalesced").(*expvar.Int)
+	waitForCoalesced := func(before int64, n int64) {
+		t.Helper()
+
+		deadline := time.Now().Add(5 * time.Second)
+		for coalesced.Value() < before+n {
+			if time.Now().After(deadline) {
+				t.Fatal("timed out waiting for coalesced requests")
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	t.Run("shares errors with the waiting requests", func(t *testing.T) {
+		a, processor := setup()
+		before := coalesced.Value()
+
+		leader := request(context.Background(), a)
+		<-processor.started
+
+		var waiters []chan *httptest.ResponseRecorder
+		for i := 0; i < 3; i++ {
+			waiters = append(waiters, request(context.Background(), a))
+		}
+		waitForCoalesced(before, 3)
+
+		processor.release <- fmt.Errorf("error")
+
+		for _, result := range append(waiters, leader) {
+			if w := <-result; w.Code != http.StatusInternalServerError {
+				t.Errorf("wrong response code, %#v", w.Code)
+			}
+		}
+
+		if calls := processor.calls.Load(); calls != 1 {
+			t.Errorf("image was processed %d times", calls)
+		}
+	})
+
+	t.Run("shares images with the waiting requests", func(t *testing.T) {
+		a, processor := setup()
+		before := coalesced.Value()
+
+		leader := request(context.Background(), a)
+		<-processor.started
+
+		waiter := request(context.Background(), a)
+		waitForCoalesced(before, 1)
+
+		processor.release <- nil
+
+		for _, result := range []chan *httptest.ResponseRecorder{leader, waiter} {
+			w := <-result
+			if w.Code != http.StatusOK {
+				t.Errorf("wrong response code, %#v", w.Code)
+			}
+
+			if body := w.Body.String(); body != "image" {
+				t.Errorf("wrong response %#v", body)
+			}
+		}
+
+		if calls := processor.calls.Load(); calls != 1 {
+			t.Errorf("image was processed %d times", calls)
+		}
+	})
+
+	t.Run("retries when the client of the in-flight request goes away", func(t *testing.T) {
+		a, processor := setup()
+		before := coalesced.Value()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		request(ctx, a)
+		<-processor.started
+
+		waiter := request(context.Background(), a)
+		waitForCoalesced(before, 1)
+
+		cancel()
+		<-processor.started
+		processor.release <- nil
+
+		w := <-waiter
+		if w.Code != http.StatusOK {
+			t.Errorf("wrong response code, %#v", w.Code)
+		}
+
+		if body := w.Body.String(); body != "image" {
+			t.Errorf("wrong response %#v", body)
+		}
+
+		if calls := processor.calls.Load(); calls != 2 {
+			t.Errorf("image was processed %d times", calls)
+		}
+	})
+}
+
+func TestDiskCache(t *testing.T) {
+	dir := t.TempDir()
+	processor := &overloadedProcessor{}
+
+	newAPI := func() *testAPI {
+		t.Helper()
+
+		diskCache, err := disk.New("test", dir, cacheSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return newTestAPI(t, processor, func(a *api.API) {
+			a.DiskCache = diskCache
+		})
+	}
+
+	if w := newAPI().get("/id/1/200/100.jpg"); w.Code != http.StatusOK {
+		t.Fatalf("wrong response code, %#v", w.Code)
+	}
+
+	// Simulate a restart, the image should be served from disk without processing it again
+	processor.overloaded.Store(true)
+
+	w := newAPI().get("/id/1/200/100.jpg")
+	if w.Code != http.StatusOK {
+		t.Fatalf("wrong response code, %#v", w.Code)
+	}
+
+	if body := w.Body.String(); body != "1-200x100" {
+		t.Errorf("wrong response %#v", body)
+	}
+
+	if degraded := w.Header().Get("Picsum-Degraded"); degraded != "" {
+		t.Errorf("wrong degraded header, %#v", degraded)
+	}
+
+	// Images cached before the processor version was part of the key could be from any version
+	t.Run("doesn't serve images processed by another version", func(t *testing.T) {
+		diskCache, err := disk.New("test", dir, cacheSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := diskCache.Set(context.Background(), "1-300x150.jpg", []byte("old version")); err != nil {
+			t.Fatal(err)
+		}
+
+		if w := newAPI().get("/id/1/300/150.jpg"); w.Code != http.StatusServiceUnavailable {
+			t.Errorf("wrong response code, %#v", w.Code)
+		}
+	})
+}
+
+func TestPeers(t *testing.T) {
+	// Start the instances before configuring them, so that we know their addresses
+	var (
+		processors [3]*overloadedProcessor
+		routers    [3]*testAPI
+		urls       []string
+	)
+
+	for i := range routers {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			routers[i].handler.ServeHTTP(w, r)
+		}))
+		defer server.Close()
+
+		urls = append(urls, server.URL)
+	}
+
+	for i := range routers {
+		processors[i] = &overloadedProcessor{}
+		routers[i] = newTestAPI(t, processors[i], func(a *api.API) {
+			a.Peers = peers.New(urls[i], urls, a.HMAC)
+		})
+	}
+
+	get := func(i int, path string) (int, string) {
+		t.Helper()
+
+		res, err := http.Get(urls[i] + routers[i].url(path))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+
+		body, _ := io.ReadAll(res.Body)
+		return res.StatusCode, string(body)
+	}
+
+	// Request the same image from every instance
+	for i := range routers {
+		code, body := get(i, "/id/1/200/100.jpg")
+		if code != http.StatusOK {
+			t.Fatalf("%d: wrong response code, %#v", i, code)
+		}
+
+		if body != "1-200x100" {
+			t.Errorf("%d: wrong response %#v", i, body)
+		}
+	}
+
+	var processed int64
+	for i := range processors {
+		processed += processors[i].processed.Load()
+	}
+
+	if processed != 1 {
+		t.Errorf("image was processed %d times", processed)
+	}
+
+	t.Run("processes the image locally if the owner fails", func(t *testing.T) {
+		for i := range processors {
+			processors[i].overloaded.Store(true)
+		}
+
+		owner, _ := peers.New(urls[0], urls, nil).Owner("1-300x150.jpg-v" + image.ProcessorVersion)
+		for i := range processors {
+			if urls[i] != owner {
+				processors[i].overloaded.Store(false)
+			}
+		}
+
+		for i := range routers {
+			if urls[i] == owner {
+				continue
+			}
+
+			code, body := get(i, "/id/1/300/150.jpg")
+			if code != http.StatusOK {
+				t.Fatalf("%d: wrong response code, %#v", i, code)
+			}
+
+			if body != "1-300x150" {
+				t.Errorf("%d: wrong response %#v", i, body)
+			}
+		}
+	})
+}
+
+func TestClientID(t *testing.T) {
+	clients := make(chan string, 1)
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		clients <- r.Header.Get(peers.ClientHeader)
+		w.Write([]byte("image"))
+	}))
+	defer peer.Close()
+
+	a := newTestAPI(t, &overloadedProcessor{}, func(a *api.API) {
+		a.ClientIPHeader = "X-Forwarded-For"
+		a.Peers = peers.New("http://self", []string{peer.URL}, a.HMAC)
+	})
+
+	tests := []struct {
+		Name     string
+		Header   map[string]string
+		Expected string
+	}{
+		// The client can set the first entry to anything, only the last one was added by the proxy
+		{"forwarded for", map[string]string{"X-Forwarded-For": "1.2.3.4, 10.0.0.1"}, "10.0.0.1"},
+		// Only peers can attribute requests to another client
+		{"unsigned peer client", map[string]string{"X-Forwarded-For": "10.0.0.1", peers.ClientHeader: "1.2.3.4"}, "10.0.0.1"},
+	}
+
+	// Find images owned by the peer, so that the client is forwarded to it
+	var paths []string
+	for width := 100; len(paths) < len(tests); width++ {
+		if _, self := a.Peers.Owner(fmt.Sprintf("1-%dx100.jpg-v%s", width, image.ProcessorVersion)); !self {
+			paths = append(paths, fmt.Sprintf("/id/1/%d/100.jpg", width))
+		}
+	}
+
+	for i, test := range tests {
+		w := a.request(context.Background(), "GET", paths[i], test.Header)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: wrong response code, %#v", test.Name, w.Code)
+		}
+
+		if client := <-clients; client != test.Expected {
+			t.Errorf("%s: wrong client %#v", test.Name, client)
+		}
+	}
+}
+
 func readFixture(fixtureName string, extension string) []byte {
 	return readFile(fixturePath(fixtureName, extension))
 }
@@ -199,9 +803,9 @@ func TestFixtures(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	log, tracer, imageProcessor, hmac := setup(t, ctx)
+	_, _, imageProcessor, hmac := setup(t, ctx)
 
-	router := api.NewAPI(imageProcessor, log, tracer, time.Minute, hmac).Router()
+	router := newTestAPI(t, imageProcessor, nil).handler
 
 	// JPEG
 	createFixture(router, hmac, "/id/1/200/120.jpg", "width_height", "jpg")
@@ -221,14 +825,23 @@ func TestFixtures(t *testing.T) {
 func setup(t *testing.T, ctx context.Context) (*logger.Logger, *tracing.Tracer, image.Processor, *hmac.HMAC) {
 	t.Helper()
 
-	log := logger.New(zap.FatalLevel)
-	tracer := test.Tracer(log)
+	log, tracer, hmac := dependencies(t)
 
 	storage, _ := fileStorage.New("../../test/fixtures/file")
-	cache := memoryCache.New()
-	imageCache := image.NewCache(tracer, cache, storage)
+	cache := memoryCache.New(cacheSize, 0)
+	imageCache := image.NewCache(tracer, cache, storage, 0, 0)
 	imageProcessor, _ := vipsProcessor.New(ctx, log, tracer, 3, imageCache)
 
+	return log, tracer, imageProcessor, hmac
+}
+
+// dependencies returns the logger, tracer and HMAC used by the API in the tests
+func dependencies(t *testing.T) (*logger.Logger, *tracing.Tracer, *hmac.HMAC) {
+	t.Helper()
+
+	log := logger.New(zap.FatalLevel)
+	tracer := test.Tracer(log)
+
 	hmac := &hmac.HMAC{
 		Key: []byte("test"),
 	}
@@ -237,7 +850,71 @@ func setup(t *testing.T, ctx context.Context) (*logger.Logger, *tracing.Tracer,
 		log.Sync()
 	})
 
-	return log, tracer, imageProcessor, hmac
+	return log, tracer, hmac
+}
+
+// testAPI is an API along with its router, and helpers for making signed requests to it
+type testAPI struct {
+	*api.API
+	handler http.Handler
+	hmac    *hmac.HMAC
+	t       *testing.T
+}
+
+// newTestAPI creates an API using the image processor, configure sets up the optional fields before the router is created
+func newTestAPI(t *testing.T, imageProcessor image.Processor, configure func(*api.API)) *testAPI {
+	t.Helper()
+
+	log, tracer, hmac := dependencies(t)
+
+	a := api.NewAPI(imageProcessor, log, tracer, time.Minute, hmac, cacheSize, cacheTTL)
+	if configure != nil {
+		configure(a)
+	}
+
+	return &testAPI{
+		API:     a,
+		handler: a.Router(),
+		hmac:    hmac,
+		t:       t,
+	}
+}
+
+// url signs the path
+func (a *testAPI) url(path string) string {
+	a.t.Helper()
+
+	u, err := url.Parse(path)
+	if err != nil {
+		a.t.Fatal(err)
+	}
+
+	signed, err := params.HMAC(a.hmac, u.Path, u.Query())
+	if err != nil {
+		a.t.Fatal(err)
+	}
+
+	return signed
+}
+
+// request makes a signed request with the headers
+func (a *testAPI) request(ctx context.Context, method string, path string, header map[string]string) *httptest.ResponseRecorder {
+	a.t.Helper()
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequestWithContext(ctx, method, a.url(path), nil)
+	for key, value := range header {
+		req.Header.Set(key, value)
+	}
+	a.handler.ServeHTTP(w, req)
+	return w
+}
+
+// get makes a signed GET request
+func (a *testAPI) get(path string) *httptest.ResponseRecorder {
+	a.t.Helper()
+
+	return a.request(context.Background(), "GET", path, nil)
 }
 
 func createFixture(router http.Handler, hmac *hmac.HMAC, URL string, fixtureName string, extension string) {
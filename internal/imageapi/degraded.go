@@ -0,0 +1,114 @@
+package imageapi
+
+import (
+	"fmt"
+	"math"
+	"sync"
+
+	"github.com/DMarby/picsum-photos/internal/params"
+)
+
+const (
+	// Variants whose aspect ratio differ by less than this are considered interchangeable when degrading
+	aspectRatioTolerance = 0.01
+	// The smallest size we degrade to, relative to the requested size
+	// Larger sizes are never served, so that clients don't get a much heavier image than they asked for
+	minDegradedScale = 0.5
+)
+
+// variantIndex keeps track of which sizes of each variant (image ID, format and options) are in the image cache,
+// so that we can serve a nearby size of an image when we're too overloaded to process the requested one
+type variantIndex struct {
+	mutex    sync.Mutex
+	variants map[string]map[string]size // variant key -> cache key -> size
+	keys     map[string]string          // cache key -> variant key
+}
+
+type size struct {
+	width  int
+	height int
+}
+
+func newVariantIndex() *variantIndex {
+	return &variantIndex{
+		variants: make(map[string]map[string]size),
+		keys:     make(map[string]string),
+	}
+}
+
+// add records that an image has been added to the cache
+func (v *variantIndex) add(cacheKey string, variantKey string, width int, height int) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	sizes, ok := v.variants[variantKey]
+	if !ok {
+		sizes = make(map[string]size)
+		v.variants[variantKey] = sizes
+	}
+
+	sizes[cacheKey] = size{width: width, height: height}
+	v.keys[cacheKey] = variantKey
+}
+
+// remove records that an image has been removed from the cache
+func (v *variantIndex) remove(cacheKey string) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	variantKey, ok := v.keys[cacheKey]
+	if !ok {
+		return
+	}
+
+	delete(v.keys, cacheKey)
+	delete(v.variants[variantKey], cacheKey)
+	if len(v.variants[variantKey]) == 0 {
+		delete(v.variants, variantKey)
+	}
+}
+
+// nearest returns the cache key of the largest cached size of the variant with the same aspect ratio that's no larger than the requested size,
+// and no smaller than minDegradedScale of it
+func (v *variantIndex) nearest(variantKey string, width int, height int) (string, size, bool) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	var (
+		bestKey  string
+		bestSize size
+		found    bool
+	)
+
+	aspectRatio := float64(width) / float64(height)
+	for cacheKey, s := range v.variants[variantKey] {
+		if math.Abs(float64(s.width)/float64(s.height)-aspectRatio)/aspectRatio > aspectRatioTolerance {
+			continue
+		}
+
+		if s.width > width || float64(s.width) < minDegradedScale*float64(width) {
+			continue
+		}
+
+		if !found || s.width > bestSize.width {
+			bestKey, bestSize, found = cacheKey, s, true
+		}
+	}
+
+	return bestKey, bestSize, found
+}
+
+// buildVariantKey creates a key identifying all the sizes of an image with the same format and options
+func buildVariantKey(imageID string, p *params.Params) string {
+	key := fmt.Sprintf("%s%s", imageID, p.Extension)
+
+	if p.Blur {
+		key += fmt.Sprintf("-blur_%d", p.BlurAmount)
+	}
+
+	if p.Grayscale {
+		key += "-grayscale"
+	}
+
+	return key
+}
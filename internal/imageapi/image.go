@@ -1,12 +1,19 @@
 package imageapi
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"expvar"
 	"fmt"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
 
+	"github.com/DMarby/picsum-photos/internal/cache"
 	"github.com/DMarby/picsum-photos/internal/handler"
 	"github.com/DMarby/picsum-photos/internal/image"
 	"github.com/DMarby/picsum-photos/internal/params"
@@ -21,6 +28,26 @@ var (
 	requestsCoalesced = expvar.NewInt("counter_imageapi_requests_coalesced")
 	requestsProcessed = expvar.NewInt("counter_imageapi_requests_processed")
 	queueFullErrors   = expvar.NewInt("counter_imageapi_queue_full_errors")
+	queueDropErrors   = expvar.NewInt("counter_imageapi_queue_drop_errors")
+	degradedResponses = expvar.NewInt("counter_imageapi_degraded_responses")
+	diskCacheHits     = expvar.NewInt("counter_imageapi_disk_cache_hits")
+	diskCacheMisses   = expvar.NewInt("counter_imageapi_disk_cache_misses")
+	diskCacheErrors   = expvar.NewInt("counter_imageapi_disk_cache_errors")
+	peerHits          = expvar.NewInt("counter_imageapi_peer_hits")
+	notModified       = expvar.NewInt("counter_imageapi_not_modified")
+
+	coalescedSuccesses = expvar.NewInt("counter_imageapi_coalesced_successes")
+	coalescedFailures  = expvar.NewInt("counter_imageapi_coalesced_failures")
+	coalescedRetries   = expvar.NewInt("counter_imageapi_coalesced_retries")
+)
+
+const (
+	// How long clients should wait before retrying when we're overloaded
+	retryAfter = 5 * time.Second
+	// How long a degraded response may be cached, so that the requested size is fetched again soon
+	degradedMaxAge = time.Minute
+	// How many times a coalesced request retries when the request it waited for failed for reasons specific to that request
+	maxCoalesceRetries = 2
 )
 
 func (a *API) imageHandler(w http.ResponseWriter, r *http.Request) *handler.Error {
@@ -47,6 +74,16 @@ func (a *API) imageHandler(w http.ResponseWriter, r *http.Request) *handler.Erro
 	// Build the cache key for request coalescing
 	cacheKey := buildCacheKey(imageID, p)
 
+	// The ETag only depends on the request, so we can answer revalidation requests without processing the image
+	// If-None-Match: * is left to sendImage, as it only matches once we know that the image exists
+	etag := buildETag(cacheKey)
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		notModified.Add(1)
+		setCacheHeaders(w, etag)
+		w.WriteHeader(http.StatusNotModified)
+		return nil
+	}
+
 	// Request coalescing with LRU cache pattern
 	// This prevents the "thundering herd" problem where many identical
 	// requests arrive simultaneously and all hit the image processor
@@ -54,34 +91,85 @@ func (a *API) imageHandler(w http.ResponseWriter, r *http.Request) *handler.Erro
 	// First, check the LRU cache for a cached result
 	if cachedImage, ok := a.imageCache.Get(cacheKey); ok {
 		cacheHits.Add(1)
-		return a.sendImage(w, imageID, p, cachedImage)
+		return a.sendImage(w, r, imageID, p, cachedImage)
 	}
 	cacheMisses.Add(1)
 
 	// Cache miss - use request coalescing to prevent duplicate processing
-	// Create a channel to signal when processing is complete
-	done := make(chan struct{})
+	processedImage, err := a.coalesce(r, imageID, p, cacheKey)
+	if err != nil {
+		return a.processingError(w, r, imageID, p, err)
+	}
+
+	return a.sendImage(w, r, imageID, p, processedImage)
+}
+
+// call is an in-flight request for a processed image, whose result is shared with concurrent requests for the same image
+type call struct {
+	done  chan struct{}
+	image []byte
+	err   error
+}
+
+// coalesce gets the processed image, sharing the result with concurrent requests for the same image
+// If the request that got the image failed for reasons specific to it, such as the client going away, we retry instead of sharing the error
+func (a *API) coalesce(r *http.Request, imageID string, p *params.Params, cacheKey string) ([]byte, error) {
+	for retries := 0; ; retries++ {
+		// Try to claim responsibility for this request
+		c := &call{done: make(chan struct{})}
+		existing, loaded := a.inflight.LoadOrStore(cacheKey, c)
+		if !loaded {
+			c.image, c.err = a.render(r, imageID, p, cacheKey)
+			if c.err != nil {
+				a.logProcessingError(r, c.err)
+			}
 
-	// Try to claim responsibility for this request
-	existing, loaded := a.inflight.LoadOrStore(cacheKey, done)
-	if loaded {
-		// Another goroutine is already processing this request, wait for it
+			// Share the result and signal completion
+			a.inflight.Delete(cacheKey)
+			close(c.done)
+
+			return c.image, c.err
+		}
+
+		// Another request is already processing this image, wait for it
 		requestsCoalesced.Add(1)
+		c = existing.(*call)
 		select {
-		case <-existing.(chan struct{}):
-			// Processing complete, result should now be in cache
-			if cachedImage, ok := a.imageCache.Get(cacheKey); ok {
-				return a.sendImage(w, imageID, p, cachedImage)
-			}
-			// Cache miss after waiting (possibly evicted or error occurred)
-			// Fall through to process the image ourselves
+		case <-c.done:
 		case <-r.Context().Done():
-			// Request was cancelled
-			return handler.InternalServerError()
+			return nil, r.Context().Err()
+		}
+
+		if c.err == nil {
+			coalescedSuccesses.Add(1)
+			return c.image, nil
 		}
+
+		retryable := errors.Is(c.err, context.Canceled) || errors.Is(c.err, context.DeadlineExceeded)
+		if !retryable || retries >= maxCoalesceRetries {
+			coalescedFailures.Add(1)
+			return nil, c.err
+		}
+
+		coalescedRetries.Add(1)
+	}
+}
+
+// render gets a processed image from the disk cache or a peer, or processes it, and stores it in the image cache
+func (a *API) render(r *http.Request, imageID string, p *params.Params, cacheKey string) ([]byte, error) {
+	// Check the disk cache, which survives restarts, and the peer that owns the image, so that it's only processed once across all instances
+	cachedImage, ok := a.getDiskCache(r, cacheKey)
+	if !ok {
+		cachedImage, ok = a.getPeer(r, cacheKey)
+	}
+
+	if ok {
+		a.imageCache.Add(cacheKey, cachedImage)
+		a.variants.add(cacheKey, buildVariantKey(imageID, p), p.Width, p.Height)
+
+		return cachedImage, nil
 	}
 
-	// We're responsible for processing this request (or retry after cache miss)
 	requestsProcessed.Add(1)
 
 	// Build the image task
@@ -94,43 +182,171 @@ func (a *API) imageHandler(w http.ResponseWriter, r *http.Request) *handler.Erro
 		task.Grayscale()
 	}
 
-	// Process the image
-	processedImage, err := a.ImageProcessor.ProcessImage(r.Context(), task)
+	// Process the image, attributing the job to the client so that the queue can be shared fairly
+	ctx := queue.WithClient(r.Context(), a.clientID(r), 1)
+	processedImage, err := a.ImageProcessor.ProcessImage(ctx, task)
+	if err != nil {
+		return nil, err
+	}
+
+	// Store in LRU cache for future requests
+	a.imageCache.Add(cacheKey, processedImage)
+	a.variants.add(cacheKey, buildVariantKey(imageID, p), p.Width, p.Height)
+	a.setDiskCache(r, cacheKey, processedImage)
+
+	return processedImage, nil
+}
 
-	// Cleanup and signal completion
-	if !loaded {
-		a.inflight.Delete(cacheKey)
-		close(done)
+// logProcessingError logs an error processing an image, it's only called once for all the coalesced requests
+func (a *API) logProcessingError(r *http.Request, err error) {
+	var panicErr *queue.PanicError
+	switch {
+	case errors.Is(err, queue.ErrQueueFull):
+		queueFullErrors.Add(1)
+		// Log the client rather than using it as a metrics label, so that we can tell who's using up the queue
+		a.Log.Errorw("error processing image: queue is full", handler.LogFields(r, "error", err, "client", a.clientID(r))...)
+	case errors.Is(err, queue.ErrDropped):
+		queueDropErrors.Add(1)
+		a.logError(r, "error processing image: dropped from queue", err)
+	case errors.As(err, &panicErr):
+		a.Log.Errorw("panic processing image", handler.LogFields(r, "error", err, "stacktrace", string(panicErr.Stack))...)
+	default:
+		a.logError(r, "error processing image", err)
+	}
+}
+
+// processingError responds to an error processing an image
+func (a *API) processingError(w http.ResponseWriter, r *http.Request, imageID string, p *params.Params, err error) *handler.Error {
+	if errors.Is(err, queue.ErrQueueFull) || errors.Is(err, queue.ErrDropped) {
+		return a.overloaded(w, r, imageID, p)
 	}
 
+	return handler.InternalServerError()
+}
+
+// getDiskCache returns a processed image from the disk cache, if there is one
+func (a *API) getDiskCache(r *http.Request, cacheKey string) ([]byte, bool) {
+	if a.DiskCache == nil {
+		return nil, false
+	}
+
+	data, err := a.DiskCache.Get(r.Context(), cacheKey)
 	if err != nil {
-		if errors.Is(err, queue.ErrQueueFull) {
-			queueFullErrors.Add(1)
-			a.logError(r, "error processing image: queue is full", err)
-			return handler.ServiceUnavailable()
+		if err != cache.ErrNotFound {
+			diskCacheErrors.Add(1)
+			a.logError(r, "error getting image from disk cache", err)
 		}
-		a.logError(r, "error processing image", err)
-		return handler.InternalServerError()
+
+		diskCacheMisses.Add(1)
+		return nil, false
 	}
 
-	// Store in LRU cache for future requests
-	a.imageCache.Add(cacheKey, processedImage)
+	diskCacheHits.Add(1)
+	return data, true
+}
+
+// getPeer fetches a processed image from the peer that owns it, unless that's us
+// If the peer fails we process the image ourselves instead
+func (a *API) getPeer(r *http.Request, cacheKey string) ([]byte, bool) {
+	if a.Peers == nil {
+		return nil, false
+	}
+
+	// Requests from peers are never forwarded again
+	if _, forwarded := a.Peers.Client(r); forwarded {
+		return nil, false
+	}
+
+	peer, self := a.Peers.Owner(cacheKey)
+	if self {
+		return nil, false
+	}
+
+	// The peer responds with a different ETag if it's running another processor version, which we don't want to serve images from
+	data, err := a.Peers.Fetch(r.Context(), peer, r.URL.RequestURI(), a.clientID(r), buildETag(cacheKey))
+	if err != nil {
+		a.logError(r, "error fetching image from peer", err)
+		return nil, false
+	}
+
+	peerHits.Add(1)
+	return data, true
+}
+
+// setDiskCache stores a processed image in the disk cache
+// Failing to do so isn't fatal, the image is just processed again after a restart
+func (a *API) setDiskCache(r *http.Request, cacheKey string, processedImage []byte) {
+	if a.DiskCache == nil {
+		return
+	}
+
+	// Store the image even if the client has gone away, as we've already done the work
+	if err := a.DiskCache.Set(context.WithoutCancel(r.Context()), cacheKey, processedImage); err != nil {
+		diskCacheErrors.Add(1)
+		a.logError(r, "error storing image in disk cache", err)
+	}
+}
+
+// overloaded responds when we're too overloaded to process the image
+// If we have a nearby size of the same image cached we serve that instead, otherwise we ask the client to retry later
+func (a *API) overloaded(w http.ResponseWriter, r *http.Request, imageID string, p *params.Params) *handler.Error {
+	variantKey := buildVariantKey(imageID, p)
+	for {
+		cacheKey, size, ok := a.variants.nearest(variantKey, p.Width, p.Height)
+		if !ok {
+			break
+		}
+
+		cachedImage, ok := a.imageCache.Get(cacheKey)
+		if !ok {
+			// The image was evicted from the cache after we looked it up
+			a.variants.remove(cacheKey)
+			continue
+		}
 
-	return a.sendImage(w, imageID, p, processedImage)
+		degradedResponses.Add(1)
+
+		degradedParams := *p
+		degradedParams.Width = size.width
+		degradedParams.Height = size.height
+
+		w.Header().Set("Picsum-Degraded", "true")
+		w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(degradedMaxAge.Seconds())))
+		// Ranges of a different image than the one requested aren't useful, always send the whole image
+		r.Header.Del("Range")
+		a.writeImage(w, r, imageID, &degradedParams, cachedImage)
+
+		return nil
+	}
+
+	w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Seconds())))
+	return handler.ServiceUnavailable()
 }
 
 // sendImage writes the processed image to the response with appropriate headers
-func (a *API) sendImage(w http.ResponseWriter, imageID string, p *params.Params, processedImage []byte) *handler.Error {
+func (a *API) sendImage(w http.ResponseWriter, r *http.Request, imageID string, p *params.Params, processedImage []byte) *handler.Error {
+	// http.ServeContent answers If-None-Match: * with a 304 now that we have the image
+	setCacheHeaders(w, buildETag(buildCacheKey(imageID, p)))
+	a.writeImage(w, r, imageID, p, processedImage)
+
+	return nil
+}
+
+// setCacheHeaders sets the headers for caching and revalidating a processed image
+func setCacheHeaders(w http.ResponseWriter, etag string) {
+	w.Header().Set("Cache-Control", "public, max-age=2592000, stale-while-revalidate=60, stale-if-error=43200, immutable") // Cache for a month
+	w.Header().Set("ETag", etag)
+}
+
+// writeImage writes the image to the response, callers are responsible for setting the Cache-Control header
+// HEAD and Range requests are handled by http.ServeContent, which also sets the Content-Length header
+func (a *API) writeImage(w http.ResponseWriter, r *http.Request, imageID string, p *params.Params, processedImage []byte) {
 	w.Header().Set("Content-Disposition", fmt.Sprintf("inline; filename=\"%s\"", buildFilename(imageID, p)))
 	w.Header().Set("Content-Type", getContentType(p.Extension))
-	w.Header().Set("Content-Length", strconv.Itoa(len(processedImage)))
-	w.Header().Set("Cache-Control", "public, max-age=2592000, stale-while-revalidate=60, stale-if-error=43200, immutable") // Cache for a month
 	w.Header().Set("Picsum-ID", imageID)
 	w.Header().Set("Timing-Allow-Origin", "*") // Allow all origins to see timing resources
 
-	w.Write(processedImage)
-
-	return nil
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(processedImage))
 }
 
 func getOutputFormat(extension string) image.OutputFormat {
@@ -152,6 +368,7 @@ func getContentType(extension string) string {
 }
 
 // buildCacheKey creates a unique key for request coalescing based on image parameters
+// It includes the processor version, so that images from a previous version in the disk cache or on a peer aren't served after an upgrade
 func buildCacheKey(imageID string, p *params.Params) string {
 	key := fmt.Sprintf("%s-%dx%d%s", imageID, p.Width, p.Height, p.Extension)
 
@@ -163,9 +380,30 @@ func buildCacheKey(imageID string, p *params.Params) string {
 		key += "-grayscale"
 	}
 
+	key += "-v" + image.ProcessorVersion
+
 	return key
 }
 
+// buildETag creates a strong ETag for a processed image
+// Processing is deterministic, so the same parameters and processor version, which are both part of the cache key, always produce the same image
+func buildETag(cacheKey string) string {
+	hash := sha256.Sum256([]byte(cacheKey))
+	return fmt.Sprintf("\"%s\"", hex.EncodeToString(hash[:16]))
+}
+
+// etagMatches checks whether an If-None-Match header lists the ETag, using the weak comparison as specified by RFC 9110
+func etagMatches(ifNoneMatch string, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+
+	return false
+}
+
 func buildFilename(imageID string, p *params.Params) string {
 	filename := fmt.Sprintf("%s-%dx%d", imageID, p.Width, p.Height)
 
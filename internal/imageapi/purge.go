@@ -0,0 +1,42 @@
+package imageapi
+
+import (
+	"context"
+)
+
+// Keys returns the keys of the processed images in the image cache and the disk cache
+func (a *API) Keys(ctx context.Context) ([]string, error) {
+	keys := a.imageCache.Keys()
+	if a.DiskCache == nil {
+		return keys, nil
+	}
+
+	diskKeys, err := a.DiskCache.Keys(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		seen[key] = true
+	}
+
+	for _, key := range diskKeys {
+		if !seen[key] {
+			keys = append(keys, key)
+		}
+	}
+
+	return keys, nil
+}
+
+// Delete removes a processed image from the image cache and the disk cache, returning the amount of bytes freed
+func (a *API) Delete(ctx context.Context, key string) (int64, error) {
+	freed, _ := a.imageCache.Remove(key)
+	if a.DiskCache == nil {
+		return freed, nil
+	}
+
+	diskFreed, err := a.DiskCache.Delete(ctx, key)
+	return freed + diskFreed, err
+}
@@ -0,0 +1,204 @@
+package lru
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// Cache is an LRU cache bounded by the total size of its values in bytes
+// Entries expire after their TTL, and the least recently used entries are evicted when the cache is full
+type Cache struct {
+	maxBytes int64
+	ttl      time.Duration
+	onEvict  func(key string, value []byte)
+
+	mutex   sync.Mutex
+	entries map[string]*list.Element
+	order   *list.List // front is the most recently used
+	bytes   int64
+	stats   Stats
+}
+
+// Stats contains statistics about the cache
+type Stats struct {
+	Entries     int
+	Bytes       int64
+	Hits        int64
+	Misses      int64
+	Evictions   int64 // entries evicted to make room for new ones
+	Expirations int64 // entries removed because their TTL passed
+}
+
+// HitRatio returns the ratio of lookups that were hits
+func (s Stats) HitRatio() float64 {
+	if s.Hits+s.Misses == 0 {
+		return 0
+	}
+
+	return float64(s.Hits) / float64(s.Hits+s.Misses)
+}
+
+type entry struct {
+	key     string
+	value   []byte
+	expires time.Time
+}
+
+// New returns a new Cache that holds up to maxBytes of data, with entries expiring after ttl
+// A ttl of zero means that entries don't expire
+// onEvict is called whenever an entry is removed from the cache, while the cache is locked, and may be nil
+func New(maxBytes int64, ttl time.Duration, onEvict func(key string, value []byte)) *Cache {
+	return &Cache{
+		maxBytes: maxBytes,
+		ttl:      ttl,
+		onEvict:  onEvict,
+		entries:  make(map[string]*list.Element),
+		order:    list.New(),
+	}
+}
+
+// Get returns an entry from the cache if it exists, marking it as recently used
+func (c *Cache) Get(key string) ([]byte, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	element, ok := c.entries[key]
+	if !ok {
+		c.stats.Misses++
+		return nil, false
+	}
+
+	e := element.Value.(*entry)
+	if c.expired(e, time.Now()) {
+		c.stats.Expirations++
+		c.removeElement(element)
+		c.stats.Misses++
+		return nil, false
+	}
+
+	c.order.MoveToFront(element)
+	c.stats.Hits++
+
+	return e.value, true
+}
+
+// Add adds an entry to the cache with the default TTL, evicting the least recently used entries if needed
+func (c *Cache) Add(key string, value []byte) {
+	c.AddWithTTL(key, value, c.ttl)
+}
+
+// AddWithTTL adds an entry to the cache with the given TTL, evicting the least recently used entries if needed
+// A ttl of zero means that the entry doesn't expire
+func (c *Cache) AddWithTTL(key string, value []byte, ttl time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if element, ok := c.entries[key]; ok {
+		c.removeElement(element)
+	}
+
+	size := int64(len(value))
+	if size > c.maxBytes {
+		// Never going to fit, don't evict everything else trying
+		return
+	}
+
+	now := time.Now()
+	var expires time.Time
+	if ttl > 0 {
+		expires = now.Add(ttl)
+	}
+
+	// Make room for the new entry, dropping expired entries first
+	c.removeExpired(now)
+	for c.bytes+size > c.maxBytes {
+		c.stats.Evictions++
+		c.removeElement(c.order.Back())
+	}
+
+	c.entries[key] = c.order.PushFront(&entry{
+		key:     key,
+		value:   value,
+		expires: expires,
+	})
+	c.bytes += size
+}
+
+// Remove removes an entry from the cache, returning the amount of bytes freed
+func (c *Cache) Remove(key string) (int64, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	element, ok := c.entries[key]
+	if !ok {
+		return 0, false
+	}
+
+	size := int64(len(element.Value.(*entry).value))
+	c.removeElement(element)
+
+	return size, true
+}
+
+// Keys returns the keys in the cache, from the most to the least recently used
+func (c *Cache) Keys() []string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	keys := make([]string, 0, len(c.entries))
+	for element := c.order.Front(); element != nil; element = element.Next() {
+		keys = append(keys, element.Value.(*entry).key)
+	}
+
+	return keys
+}
+
+// Len returns the number of entries in the cache
+func (c *Cache) Len() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return len(c.entries)
+}
+
+// Stats returns statistics about the cache
+func (c *Cache) Stats() Stats {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	stats := c.stats
+	stats.Entries = len(c.entries)
+	stats.Bytes = c.bytes
+
+	return stats
+}
+
+func (c *Cache) expired(e *entry, now time.Time) bool {
+	return !e.expires.IsZero() && now.After(e.expires)
+}
+
+// removeExpired removes expired entries, starting from the least recently used ones
+// Entries with different TTLs may be out of order, those are removed when they're looked up or evicted instead
+func (c *Cache) removeExpired(now time.Time) {
+	for element := c.order.Back(); element != nil; element = c.order.Back() {
+		if !c.expired(element.Value.(*entry), now) {
+			return
+		}
+
+		c.stats.Expirations++
+		c.removeElement(element)
+	}
+}
+
+func (c *Cache) removeElement(element *list.Element) {
+	e := element.Value.(*entry)
+
+	c.order.Remove(element)
+	delete(c.entries, e.key)
+	c.bytes -= int64(len(e.value))
+
+	if c.onEvict != nil {
+		c.onEvict(e.key, e.value)
+	}
+}
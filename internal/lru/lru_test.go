@@ -0,0 +1,107 @@
+package lru_test
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/DMarby/picsum-photos/internal/lru"
+)
+
+func TestLRU(t *testing.T) {
+	t.Run("get item", func(t *testing.T) {
+		cache := lru.New(10, 0, nil)
+		cache.Add("foo", []byte("bar"))
+
+		data, ok := cache.Get("foo")
+		if !ok {
+			t.Fatal("not found")
+		}
+
+		if string(data) != "bar" {
+			t.Fatal("wrong data")
+		}
+
+		if _, ok := cache.Get("notfound"); ok {
+			t.Fatal("found nonexistant item")
+		}
+
+		stats := cache.Stats()
+		if stats.Hits != 1 || stats.Misses != 1 || stats.HitRatio() != 0.5 {
+			t.Fatalf("wrong stats %+v", stats)
+		}
+	})
+
+	t.Run("evicts least recently used items when full", func(t *testing.T) {
+		var evicted []string
+		cache := lru.New(10, 0, func(key string, value []byte) {
+			evicted = append(evicted, key)
+		})
+
+		cache.Add("a", []byte("aaaa"))
+		cache.Add("b", []byte("bbbb"))
+		cache.Get("a")
+		cache.Add("c", []byte("cccc"))
+
+		if !reflect.DeepEqual(evicted, []string{"b"}) {
+			t.Fatalf("wrong evicted items %v", evicted)
+		}
+
+		if !reflect.DeepEqual(cache.Keys(), []string{"c", "a"}) {
+			t.Fatalf("wrong keys %v", cache.Keys())
+		}
+
+		stats := cache.Stats()
+		if stats.Bytes != 8 || stats.Entries != 2 || stats.Evictions != 1 {
+			t.Fatalf("wrong stats %+v", stats)
+		}
+	})
+
+	t.Run("doesn't add items larger then the cache", func(t *testing.T) {
+		cache := lru.New(10, 0, nil)
+		cache.Add("a", []byte("aaaa"))
+		cache.Add("b", []byte("bbbbbbbbbbb"))
+
+		if _, ok := cache.Get("b"); ok {
+			t.Fatal("found item larger then the cache")
+		}
+
+		if _, ok := cache.Get("a"); !ok {
+			t.Fatal("evicted item for item larger then the cache")
+		}
+	})
+
+	t.Run("expires items", func(t *testing.T) {
+		cache := lru.New(10, time.Millisecond, nil)
+		cache.Add("a", []byte("aaaa"))
+		cache.AddWithTTL("b", []byte("bbbb"), time.Hour)
+
+		time.Sleep(5 * time.Millisecond)
+
+		if _, ok := cache.Get("a"); ok {
+			t.Fatal("found expired item")
+		}
+
+		if _, ok := cache.Get("b"); !ok {
+			t.Fatal("expired item with longer ttl")
+		}
+
+		if stats := cache.Stats(); stats.Expirations != 1 || stats.Bytes != 4 {
+			t.Fatalf("wrong stats %+v", stats)
+		}
+	})
+
+	t.Run("remove item", func(t *testing.T) {
+		cache := lru.New(10, 0, nil)
+		cache.Add("a", []byte("aaaa"))
+
+		freed, ok := cache.Remove("a")
+		if !ok || freed != 4 {
+			t.Fatalf("wrong result %d %t", freed, ok)
+		}
+
+		if cache.Len() != 0 {
+			t.Fatal("item not removed")
+		}
+	})
+}
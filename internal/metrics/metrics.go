@@ -11,11 +11,16 @@ import (
 )
 
 // Serve starts an http server for metrics and healthchecks
-func Serve(ctx context.Context, log *logger.Logger, healthChecker *health.Checker, listenAddress string) {
+// The admin handler, if any, is served under /admin/
+func Serve(ctx context.Context, log *logger.Logger, healthChecker *health.Checker, admin http.Handler, listenAddress string) {
 	router := http.NewServeMux()
 	router.HandleFunc("/metrics", handler.VarzHandler)
 	router.Handle("/health", handler.Health(healthChecker))
 
+	if admin != nil {
+		router.Handle("/admin/", admin)
+	}
+
 	router.HandleFunc("/debug/pprof/", pprof.Index)
 	router.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
 	router.HandleFunc("/debug/pprof/profile", pprof.Profile)
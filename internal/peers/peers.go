@@ -0,0 +1,197 @@
+package peers
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/DMarby/picsum-photos/internal/hmac"
+)
+
+const (
+	// Number of points each peer gets on the hash ring, to spread keys evenly between them
+	replicas = 50
+
+	// ClientHeader is set on requests forwarded to a peer, containing the identity of the client that made the original request
+	ClientHeader = "Picsum-Peer-Client"
+	// SignatureHeader is set on requests forwarded to a peer, containing a HMAC of the path, the client identity and the timestamp
+	// It proves that the request came from a peer, so clients can't pick their own identity by setting ClientHeader themselves
+	SignatureHeader = "Picsum-Peer-Signature"
+	// TimestampHeader is set on requests forwarded to a peer, containing the unix time the request was signed at
+	TimestampHeader = "Picsum-Peer-Timestamp"
+
+	// How far the timestamp of a signature can be from the current time, so that captured signatures can't be replayed later on
+	// This also allows for some clock skew between the peers
+	maxSignatureAge = time.Minute
+
+	// How long to wait for a peer before processing the image ourselves
+	fetchTimeout = 30 * time.Second
+)
+
+var (
+	peerFetches           = expvar.NewInt("counter_peers_fetches")
+	peerFetchErrors       = expvar.NewInt("counter_peers_fetch_errors")
+	peerInvalidSignatures = expvar.NewInt("counter_peers_invalid_signatures")
+)
+
+// ErrPeer is returned when a peer responds with an error
+var ErrPeer = errors.New("peer error")
+
+// Pool is a set of image-service instances sharing their processed images with each other
+// Each key is owned by one of the peers, picked using consistent hashing, so that adding or removing a peer only moves a fraction of the keys
+type Pool struct {
+	self   string
+	hashes []uint32          // sorted points on the hash ring
+	ring   map[uint32]string // point -> peer
+	hmac   *hmac.HMAC
+	client *http.Client
+}
+
+// New returns a new Pool for the peers with the given base URLs, where self is the base URL of this instance
+// All the instances must be configured with the same list of peers, in any order, and the same HMAC key
+func New(self string, peers []string, hmac *hmac.HMAC) *Pool {
+	p := &Pool{
+		self: normalize(self),
+		ring: make(map[uint32]string),
+		hmac: hmac,
+		client: &http.Client{
+			Timeout: fetchTimeout,
+		},
+	}
+
+	for _, peer := range append([]string{self}, peers...) {
+		peer = normalize(peer)
+		for i := 0; i < replicas; i++ {
+			hash := crc32.ChecksumIEEE([]byte(strconv.Itoa(i) + peer))
+			if _, ok := p.ring[hash]; ok {
+				continue
+			}
+
+			p.ring[hash] = peer
+			p.hashes = append(p.hashes, hash)
+		}
+	}
+
+	sort.Slice(p.hashes, func(i, j int) bool {
+		return p.hashes[i] < p.hashes[j]
+	})
+
+	return p
+}
+
+// Owner returns the base URL of the peer that owns the key, and whether that's this instance
+func (p *Pool) Owner(key string) (string, bool) {
+	hash := crc32.ChecksumIEEE([]byte(key))
+	i := sort.Search(len(p.hashes), func(i int) bool {
+		return p.hashes[i] >= hash
+	})
+
+	// Wrap around the ring
+	if i == len(p.hashes) {
+		i = 0
+	}
+
+	peer := p.ring[p.hashes[i]]
+	return peer, peer == p.self
+}
+
+// Fetch requests the path, including the query string, from the peer on behalf of the client
+// The peer must respond with the ETag, so that images the peer processed differently, such as with another version, aren't used
+func (p *Pool) Fetch(ctx context.Context, peer string, path string, clientID string, etag string) ([]byte, error) {
+	peerFetches.Add(1)
+
+	data, err := p.fetch(ctx, peer, path, clientID, etag)
+	if err != nil {
+		peerFetchErrors.Add(1)
+		return nil, err
+	}
+
+	return data, nil
+}
+
+func (p *Pool) fetch(ctx context.Context, peer string, path string, clientID string, etag string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, peer+path, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	signature, err := p.hmac.Create(signatureMessage(path, clientID, timestamp))
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set(ClientHeader, clientID)
+	req.Header.Set(SignatureHeader, signature)
+	req.Header.Set(TimestampHeader, timestamp)
+
+	res, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		io.Copy(io.Discard, res.Body)
+		return nil, fmt.Errorf("%w: %s responded with %s", ErrPeer, peer, res.Status)
+	}
+
+	// Degraded responses aren't what we asked for, we'd rather try processing the image ourselves
+	if res.Header.Get("Picsum-Degraded") != "" {
+		io.Copy(io.Discard, res.Body)
+		return nil, fmt.Errorf("%w: %s responded with a degraded image", ErrPeer, peer)
+	}
+
+	if res.Header.Get("ETag") != etag {
+		io.Copy(io.Discard, res.Body)
+		return nil, fmt.Errorf("%w: %s responded with etag %s rather than %s", ErrPeer, peer, res.Header.Get("ETag"), etag)
+	}
+
+	return io.ReadAll(res.Body)
+}
+
+// Client returns the identity of the client that made the original request, if the request was forwarded by a peer
+func (p *Pool) Client(r *http.Request) (string, bool) {
+	clientID := r.Header.Get(ClientHeader)
+	if clientID == "" {
+		return "", false
+	}
+
+	timestamp := r.Header.Get(TimestampHeader)
+	signed, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		peerInvalidSignatures.Add(1)
+		return "", false
+	}
+
+	if age := time.Since(time.Unix(signed, 0)); age > maxSignatureAge || age < -maxSignatureAge {
+		peerInvalidSignatures.Add(1)
+		return "", false
+	}
+
+	valid, err := p.hmac.Validate(signatureMessage(r.URL.RequestURI(), clientID, timestamp), r.Header.Get(SignatureHeader))
+	if err != nil || !valid {
+		peerInvalidSignatures.Add(1)
+		return "", false
+	}
+
+	return clientID, true
+}
+
+// signatureMessage returns the message signed for a forwarded request
+// The path is included so that a signature can't be reused for other images, and the timestamp so that it can't be reused later on
+func signatureMessage(path string, clientID string, timestamp string) string {
+	return path + "\n" + clientID + "\n" + timestamp
+}
+
+func normalize(peer string) string {
+	return strings.TrimSuffix(strings.TrimSpace(peer), "/")
+}
@@ -0,0 +1,177 @@
+package peers_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/DMarby/picsum-photos/internal/hmac"
+	"github.com/DMarby/picsum-photos/internal/peers"
+)
+
+var urls = []string{"http://10.0.0.1:8081", "http://10.0.0.2:8081", "http://10.0.0.3:8081"}
+
+var key = &hmac.HMAC{Key: []byte("test")}
+
+func TestOwner(t *testing.T) {
+	pools := []*peers.Pool{
+		peers.New(urls[0], urls, key),
+		peers.New(urls[1], []string{urls[2], urls[0], urls[1]}, key),
+		peers.New(urls[2]+"/", urls, key),
+	}
+
+	owned := make(map[string]int)
+	for i := 0; i < 3000; i++ {
+		key := fmt.Sprintf("%d-200x300.jpg", i)
+
+		owner, self := pools[0].Owner(key)
+		owned[owner]++
+
+		for j, pool := range pools {
+			peer, isSelf := pool.Owner(key)
+			if peer != owner {
+				t.Fatalf("%s: pool %d disagrees on the owner, %s != %s", key, j, peer, owner)
+			}
+
+			if isSelf != (urls[j] == owner) {
+				t.Fatalf("%s: pool %d is wrong about owning the key", key, j)
+			}
+		}
+
+		if self != (owner == urls[0]) {
+			t.Fatalf("%s: wrong self", key)
+		}
+	}
+
+	for _, url := range urls {
+		if owned[url] < 500 {
+			t.Errorf("%s owns too few keys, %d", url, owned[url])
+		}
+	}
+}
+
+func TestRemovePeer(t *testing.T) {
+	pool := peers.New(urls[0], urls, key)
+	smallerPool := peers.New(urls[0], urls[:2], key)
+
+	moved := 0
+	for i := 0; i < 3000; i++ {
+		key := fmt.Sprintf("%d-200x300.jpg", i)
+
+		owner, _ := pool.Owner(key)
+		newOwner, _ := smallerPool.Owner(key)
+		if owner != urls[2] && owner != newOwner {
+			moved++
+		}
+	}
+
+	if moved != 0 {
+		t.Errorf("%d keys moved between the remaining peers", moved)
+	}
+}
+
+func TestFetch(t *testing.T) {
+	var pool *peers.Pool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if client, ok := pool.Client(r); !ok || client != "127.0.0.2" {
+			t.Errorf("wrong client %#v", client)
+		}
+
+		switch r.URL.Path {
+		case "/ok":
+			w.Header().Set("ETag", `"1"`)
+			w.Write([]byte(r.URL.RawQuery))
+		case "/degraded":
+			w.Header().Set("ETag", `"1"`)
+			w.Header().Set("Picsum-Degraded", "true")
+			w.Write([]byte("degraded"))
+		case "/other-version":
+			w.Header().Set("ETag", `"2"`)
+			w.Write([]byte("other version"))
+		default:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	ctx := context.Background()
+	pool = peers.New(urls[0], []string{server.URL}, key)
+
+	data, err := pool.Fetch(ctx, server.URL, "/ok?foo=bar", "127.0.0.2", `"1"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(data) != "foo=bar" {
+		t.Errorf("wrong data %s", data)
+	}
+
+	for _, path := range []string{"/degraded", "/other-version", "/unavailable"} {
+		if _, err := pool.Fetch(ctx, server.URL, path, "127.0.0.2", `"1"`); !errors.Is(err, peers.ErrPeer) {
+			t.Errorf("%s: wrong error %v", path, err)
+		}
+	}
+}
+
+func TestClient(t *testing.T) {
+	pool := peers.New(urls[0], urls, key)
+	otherPool := peers.New(urls[0], urls, &hmac.HMAC{Key: []byte("other")})
+
+	// Capture the headers of a forwarded request
+	var header http.Header
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header.Clone()
+		w.Header().Set("ETag", `"1"`)
+	}))
+	defer server.Close()
+
+	if _, err := pool.Fetch(context.Background(), server.URL, "/id/1/200/300.jpg", "127.0.0.2", `"1"`); err != nil {
+		t.Fatal(err)
+	}
+
+	// Signs the request like a peer would at the time, for signatures that can't be captured from a request made now
+	signedAt := func(path string, signed time.Time) http.Header {
+		timestamp := strconv.FormatInt(signed.Unix(), 10)
+		signature, err := key.Create(path + "\n127.0.0.2\n" + timestamp)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return http.Header{peers.ClientHeader: {"127.0.0.2"}, peers.SignatureHeader: {signature}, peers.TimestampHeader: {timestamp}}
+	}
+
+	retimed := header.Clone()
+	retimed.Set(peers.TimestampHeader, strconv.FormatInt(time.Now().Add(time.Second).Unix(), 10))
+
+	tests := []struct {
+		Name     string
+		Pool     *peers.Pool
+		Path     string
+		Header   http.Header
+		Expected string
+	}{
+		{"forwarded by a peer", pool, "/id/1/200/300.jpg", header, "127.0.0.2"},
+		{"set by the client", pool, "/id/1/200/300.jpg", http.Header{peers.ClientHeader: {"127.0.0.2"}}, ""},
+		{"signed for another path", pool, "/id/2/200/300.jpg", header, ""},
+		{"signed with another key", otherPool, "/id/1/200/300.jpg", header, ""},
+		{"with another timestamp", pool, "/id/1/200/300.jpg", retimed, ""},
+		{"signed recently", pool, "/id/1/200/300.jpg", signedAt("/id/1/200/300.jpg", time.Now().Add(-30*time.Second)), "127.0.0.2"},
+		{"signed too long ago", pool, "/id/1/200/300.jpg", signedAt("/id/1/200/300.jpg", time.Now().Add(-2*time.Minute)), ""},
+		{"signed in the future", pool, "/id/1/200/300.jpg", signedAt("/id/1/200/300.jpg", time.Now().Add(2*time.Minute)), ""},
+	}
+
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", test.Path, nil)
+		r.Header = test.Header
+
+		client, ok := test.Pool.Client(r)
+		if client != test.Expected || ok != (test.Expected != "") {
+			t.Errorf("%s: wrong client %#v", test.Name, client)
+		}
+	}
+}
@@ -0,0 +1,29 @@
+package queue
+
+import (
+	"expvar"
+	"fmt"
+	"testing"
+)
+
+func TestCappedMap(t *testing.T) {
+	m := &cappedMap{Map: new(expvar.Map), Max: 3, Other: "other"}
+
+	for i := 0; i < 5; i++ {
+		m.Add(fmt.Sprintf("client-%d", i), 1)
+	}
+
+	// Clients that already have a key keep being counted under it
+	m.Add("client-0", 1)
+
+	expected := map[string]string{"client-0": "2", "client-1": "1", "client-2": "1", "other": "2"}
+
+	counts := make(map[string]string)
+	m.Do(func(kv expvar.KeyValue) {
+		counts[kv.Key] = kv.Value.String()
+	})
+
+	if fmt.Sprint(counts) != fmt.Sprint(expected) {
+		t.Errorf("wrong counts %v", counts)
+	}
+}
@@ -3,25 +3,119 @@ package queue
 import (
 	"context"
 	"errors"
+	"expvar"
 	"fmt"
+	"math"
 	"runtime"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"tailscale.com/metrics"
+)
+
+// Errors
+var (
+	// ErrQueueFull is returned when the queue buffer is full
+	ErrQueueFull = errors.New("queue is full")
+	// ErrClientQueueFull is returned when a client has used up its share of the queue buffer
+	ErrClientQueueFull = fmt.Errorf("client %w", ErrQueueFull)
+	// ErrDropped is returned when a job is shed because it has, or would have, waited in the queue for too long
+	ErrDropped = errors.New("job dropped due to queue delay")
+)
+
+const (
+	// Number of buffered jobs per worker
+	bufferPerWorker = 64
+	// A single client may hold at most 1/clientShare of the buffer per unit of weight
+	clientShare = 4
+
+	// Jobs that have waited in the queue for longer than this are always dropped
+	maxWait = 10 * time.Second
+	// Load shedding kicks in when the wait time has stayed above the target for a full interval, see https://queue.acm.org/detail.cfm?id=2209336
+	codelTarget   = 500 * time.Millisecond
+	codelInterval = 5 * time.Second
+
+	// Weight of the latest sample in the processing time moving average
+	ewmaWeight = 0.1
 )
 
-// ErrQueueFull is returned when the queue buffer is full
-var ErrQueueFull = errors.New("queue is full")
+// Rejection reasons
+const (
+	rejectQueueFull  = "queue_full"
+	rejectClientFull = "client_full"
+)
+
+// Rejections are counted per client for up to maxClientLabels clients, the rest are counted as otherClients,
+// as there's no bound on how many clients there are
+const (
+	maxClientLabels = 100
+	otherClients    = "other"
+)
+
+// Drop reasons
+const (
+	dropDeadline = "deadline"
+	dropMaxWait  = "max_wait"
+	dropCoDel    = "codel"
+)
+
+var (
+	rejectedJobs     = expvar.NewMap("counter_labelmap_reason_queue_rejected_jobs")
+	clientRejections = &cappedMap{Map: expvar.NewMap("counter_labelmap_client_queue_rejections"), Max: maxClientLabels, Other: otherClients}
+	droppedJobs      = expvar.NewMap("counter_labelmap_reason_queue_dropped_jobs")
+	waitTime         = metrics.NewHistogram([]float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30})
+	workerCount      = expvar.NewInt("gauge_queue_workers")
+	workerRestarts   = expvar.NewInt("counter_queue_worker_restarts")
+)
+
+func init() {
+	expvar.Publish("histogram_queue_wait_seconds", waitTime)
+}
 
 // Queue is a worker queue with a fixed amount of workers
+// Jobs are buffered per client, and handed out to the workers in a weighted round-robin fashion,
+// so that a single client can't starve everyone else of queue slots
 type Queue struct {
-	workers int
-	queue   chan job
-	handler func(context.Context, interface{}) (interface{}, error)
-	ctx     context.Context
+	workers     int
+	capacity    int
+	clientLimit int
+	handler     func(context.Context, interface{}) (interface{}, error)
+	ctx         context.Context
+
+	// Holds one token per buffered job, workers block on it while waiting for work
+	queue chan struct{}
+
+	mutex   sync.Mutex
+	closed  bool
+	length  int
+	clients map[string]*client
+	active  []*client // clients with buffered jobs, in round-robin order
+	next    int       // index into active of the client to serve next
+
+	// Moving average of how long jobs take to process
+	processEstimate time.Duration
+
+	// Load shedding state
+	firstAboveTime time.Time // when the wait time will have been above the target for a full interval
+	dropping       bool      // whether we're currently shedding load
+	dropNext       time.Time // when to drop the next job while shedding load
+	dropCount      int       // jobs dropped since we started shedding load
+}
+
+// client holds the buffered jobs for a single client
+type client struct {
+	id     string
+	weight int
+	jobs   []job
+	served int // jobs served in the current round
 }
 
 type job struct {
-	data    interface{}
-	result  chan jobResult
-	context context.Context
+	data     interface{}
+	result   chan jobResult
+	context  context.Context
+	enqueued time.Time
 }
 
 type jobResult struct {
@@ -29,13 +123,53 @@ type jobResult struct {
 	err    error
 }
 
+// PanicError is returned when the handler panics while processing a job
+type PanicError struct {
+	Value interface{}
+	Stack []byte
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("panic while processing job: %v", e.Value)
+}
+
+type clientKey struct{}
+
+type clientInfo struct {
+	id     string
+	weight int
+}
+
+// WithClient returns a context that attributes queued jobs to the given client identity
+// The weight determines the client's share of both the queue slots and the worker time relative to other clients
+func WithClient(ctx context.Context, id string, weight int) context.Context {
+	if weight < 1 {
+		weight = 1
+	}
+
+	return context.WithValue(ctx, clientKey{}, clientInfo{id: id, weight: weight})
+}
+
+func clientFromContext(ctx context.Context) clientInfo {
+	if info, ok := ctx.Value(clientKey{}).(clientInfo); ok {
+		return info
+	}
+
+	return clientInfo{weight: 1}
+}
+
 // New creates a new Queue with the specified amount of workers
 func New(ctx context.Context, workers int, handler func(context.Context, interface{}) (interface{}, error)) *Queue {
+	capacity := workers * bufferPerWorker
+
 	queue := &Queue{
-		workers: workers,
-		queue:   make(chan job, workers*64),
-		handler: handler,
-		ctx:     ctx,
+		workers:     workers,
+		capacity:    capacity,
+		clientLimit: max(capacity/clientShare, 1),
+		handler:     handler,
+		ctx:         ctx,
+		queue:       make(chan struct{}, capacity),
+		clients:     make(map[string]*client),
 	}
 
 	return queue
@@ -48,61 +182,253 @@ func (q *Queue) Run() {
 	}
 
 	<-q.ctx.Done()
+
+	q.mutex.Lock()
+	q.closed = true
 	close(q.queue)
+	q.mutex.Unlock()
 }
 
 func (q *Queue) worker() {
 	// Lock the thread to ensure that we get our own thread, and that tasks aren't moved between threads
 	// We won't unlock since it's uncertain how libvips would react
+	// This also means that the thread is terminated rather than reused when the worker exits
 	runtime.LockOSThread()
 
+	workerCount.Add(1)
+	defer workerCount.Add(-1)
+
 	for {
 		select {
-		case job, open := <-q.queue:
+		case _, open := <-q.queue:
 			if !open {
 				return
 			}
 
+			job, dropReason := q.dequeue()
+
 			// Check if the job context was cancelled before processing
 			if job.context.Err() != nil {
 				job.result <- jobResult{result: nil, err: job.context.Err()}
 				continue
 			}
 
-			result, err := q.handler(job.context, job.data)
+			if dropReason != "" {
+				droppedJobs.Add(dropReason, 1)
+				job.result <- jobResult{result: nil, err: ErrDropped}
+				continue
+			}
+
+			start := time.Now()
+			result, err := q.handle(job)
+			q.observeProcessTime(time.Since(start))
 			job.result <- jobResult{result: result, err: err}
 
+			// The thread may have been left in a bad state by the panic, replace it with a fresh worker and thread
+			if _, ok := err.(*PanicError); ok {
+				workerRestarts.Add(1)
+				go q.worker()
+				return
+			}
+
 		case <-q.ctx.Done():
 			return
 		}
 	}
 }
 
+// handle runs the handler for a job, recovering from any panics and returning them as a PanicError
+func (q *Queue) handle(j job) (result interface{}, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			result = nil
+			err = &PanicError{Value: r, Stack: debug.Stack()}
+		}
+	}()
+
+	return q.handler(j.context, j.data)
+}
+
+// enqueue adds a job to the buffer of the client it belongs to
+func (q *Queue) enqueue(info clientInfo, j job) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if q.closed {
+		return fmt.Errorf("queue has been shutdown")
+	}
+
+	if q.length >= q.capacity {
+		return ErrQueueFull
+	}
+
+	// Fail fast if the job would time out before it's done processing anyway
+	// It'll have to wait for the jobs ahead of it to be processed, and then be processed itself
+	estimate := q.processEstimate * time.Duration(q.length/q.workers+1)
+	if deadline, ok := j.context.Deadline(); ok && time.Until(deadline) < estimate {
+		droppedJobs.Add(dropDeadline, 1)
+		return ErrDropped
+	}
+
+	c, ok := q.clients[info.id]
+	if !ok {
+		c = &client{id: info.id}
+		q.clients[info.id] = c
+		q.active = append(q.active, c)
+	}
+	c.weight = info.weight
+
+	// Jobs that aren't attributed to a client are only bound by the total capacity
+	if info.id != "" && len(c.jobs) >= min(q.clientLimit*c.weight, q.capacity) {
+		return ErrClientQueueFull
+	}
+
+	c.jobs = append(c.jobs, j)
+	q.length++
+
+	// There's always room for the token, since there's never more tokens than buffered jobs
+	q.queue <- struct{}{}
+
+	return nil
+}
+
+// dequeue removes the next job from the buffer, serving each client up to its weight in jobs before moving on to the next one
+// If the job should be shed rather than processed, the reason is returned along with it
+// Callers must hold a token from the queue channel, which guarantees that there's a job to return
+func (q *Queue) dequeue() (job, string) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	c := q.active[q.next]
+	j := c.jobs[0]
+	c.jobs[0] = job{}
+	c.jobs = c.jobs[1:]
+	c.served++
+	q.length--
+
+	if len(c.jobs) == 0 {
+		// The client has no more buffered jobs, remove it from the rotation
+		c.served = 0
+		delete(q.clients, c.id)
+		q.active = append(q.active[:q.next], q.active[q.next+1:]...)
+	} else if c.served >= c.weight {
+		// The client has used up its share for this round, move on to the next one
+		c.served = 0
+		q.next++
+	}
+
+	if q.next >= len(q.active) {
+		q.next = 0
+	}
+
+	now := time.Now()
+	wait := now.Sub(j.enqueued)
+	waitTime.Observe(wait.Seconds())
+
+	return j, q.dropReason(j, now, wait)
+}
+
+// dropReason decides whether a job should be shed, using a CoDel-like algorithm
+// When the wait time has stayed above the target for a full interval we start dropping jobs,
+// at an increasing rate until the wait time goes back below the target
+func (q *Queue) dropReason(j job, now time.Time, wait time.Duration) string {
+	okToDrop := false
+	if wait < codelTarget || q.length == 0 {
+		// Reset the interval when the wait time goes below the target, or when the queue drains
+		q.firstAboveTime = time.Time{}
+	} else if q.firstAboveTime.IsZero() {
+		q.firstAboveTime = now.Add(codelInterval)
+	} else if !now.Before(q.firstAboveTime) {
+		okToDrop = true
+	}
+
+	reason := ""
+	if q.dropping {
+		if !okToDrop {
+			q.dropping = false
+		} else if !now.Before(q.dropNext) {
+			reason = dropCoDel
+			q.dropCount++
+			q.dropNext = controlLaw(q.dropNext, q.dropCount)
+		}
+	} else if okToDrop {
+		reason = dropCoDel
+		q.dropping = true
+		q.dropCount = 1
+		q.dropNext = controlLaw(now, q.dropCount)
+	}
+
+	if wait > maxWait {
+		reason = dropMaxWait
+	}
+
+	// Drop jobs that would time out before they're done processing anyway
+	if deadline, ok := j.context.Deadline(); ok && deadline.Sub(now) < q.processEstimate {
+		reason = dropDeadline
+	}
+
+	return reason
+}
+
+// controlLaw returns when to drop the next job, the more jobs we've dropped the sooner we drop the next one
+func controlLaw(t time.Time, count int) time.Time {
+	return t.Add(time.Duration(float64(codelInterval) / math.Sqrt(float64(count))))
+}
+
+// observeProcessTime updates the moving average of how long jobs take to process
+func (q *Queue) observeProcessTime(duration time.Duration) {
+	q.mutex.Lock()
+	q.processEstimate = ewma(q.processEstimate, duration)
+	q.mutex.Unlock()
+}
+
+// ewma adds a sample to an exponentially weighted moving average
+func ewma(average time.Duration, sample time.Duration) time.Duration {
+	if average == 0 {
+		return sample
+	}
+
+	return time.Duration(ewmaWeight*float64(sample) + (1-ewmaWeight)*float64(average))
+}
+
 // Len returns the current number of jobs waiting in the queue buffer
 func (q *Queue) Len() int {
-	return len(q.queue)
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	return q.length
 }
 
 // Process adds a job to the queue, waits for it to process, and returns the result
+// Jobs are attributed to the client set on the context with WithClient
 func (q *Queue) Process(ctx context.Context, data interface{}) (interface{}, error) {
 	if q.ctx.Err() != nil {
 		return nil, fmt.Errorf("queue has been shutdown")
 	}
 
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+
 	resultChan := make(chan jobResult, 1)
 
-	select {
-	case q.queue <- job{
-		data:    data,
-		result:  resultChan,
-		context: ctx,
-	}:
-	case <-q.ctx.Done():
-		return nil, fmt.Errorf("queue has been shutdown")
-	case <-ctx.Done():
-		return nil, ctx.Err()
-	default:
-		return nil, ErrQueueFull
+	info := clientFromContext(ctx)
+	err := q.enqueue(info, job{
+		data:     data,
+		result:   resultChan,
+		context:  ctx,
+		enqueued: time.Now(),
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrClientQueueFull):
+			rejectedJobs.Add(rejectClientFull, 1)
+		case errors.Is(err, ErrQueueFull):
+			rejectedJobs.Add(rejectQueueFull, 1)
+		}
+		clientRejections.Add(info.id, 1)
+
+		return nil, err
 	}
 
 	select {
@@ -116,5 +442,33 @@ func (q *Queue) Process(ctx context.Context, data interface{}) (interface{}, err
 		// Context cancelled - but worker may still be processing
 		// At least we can return early and not waste this goroutine
 		return nil, ctx.Err()
+	case <-q.ctx.Done():
+		return nil, fmt.Errorf("queue has been shutdown")
+	}
+}
+
+// cappedMap is an expvar.Map with at most Max keys, once it's full new keys are counted under Other instead
+type cappedMap struct {
+	*expvar.Map
+	Max   int
+	Other string
+
+	mutex sync.Mutex
+	keys  int
+}
+
+// Add adds delta to the value for the key, or for Other if the map is full
+func (m *cappedMap) Add(key string, delta int64) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.Map.Get(key) == nil {
+		if m.keys >= m.Max {
+			key = m.Other
+		} else {
+			m.keys++
+		}
 	}
+
+	m.Map.Add(key, delta)
 }
@@ -2,8 +2,13 @@ package queue_test
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"reflect"
+	"runtime"
+	"sync"
 	"testing"
+	"time"
 
 	queue "github.com/DMarby/picsum-photos/internal/queue"
 )
@@ -75,3 +80,156 @@ func TestTaskWithCancelledContext(t *testing.T) {
 		t.Fatal("Invalid error")
 	}
 }
+
+func TestClientLimit(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	release := make(chan struct{})
+	started := make(chan struct{}, 1)
+	workerQueue := queue.New(ctx, 1, func(ctx context.Context, data interface{}) (interface{}, error) {
+		started <- struct{}{}
+		<-release
+		return data, nil
+	})
+	go workerQueue.Run()
+	defer close(release)
+
+	// Occupy the worker so that the following jobs stay buffered
+	go workerQueue.Process(context.Background(), "busy")
+	<-started
+
+	// A single client may only use a quarter of the buffer
+	noisyCtx := queue.WithClient(context.Background(), "noisy", 1)
+	for i := 0; i < 16; i++ {
+		go workerQueue.Process(noisyCtx, "noisy")
+	}
+
+	for workerQueue.Len() < 16 {
+		runtime.Gosched()
+	}
+
+	_, err := workerQueue.Process(noisyCtx, "noisy")
+	if !errors.Is(err, queue.ErrClientQueueFull) || !errors.Is(err, queue.ErrQueueFull) {
+		t.Fatalf("wrong error %s", err)
+	}
+
+	// Other clients still get their share of the buffer
+	quietCtx, quietCancel := context.WithCancel(queue.WithClient(context.Background(), "quiet", 1))
+	go workerQueue.Process(quietCtx, "quiet")
+	for workerQueue.Len() < 17 {
+		runtime.Gosched()
+	}
+	quietCancel()
+}
+
+func TestFairness(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	release := make(chan struct{})
+	started := make(chan struct{})
+	var mutex sync.Mutex
+	var order []string
+	workerQueue := queue.New(ctx, 1, func(ctx context.Context, data interface{}) (interface{}, error) {
+		if data == "busy" {
+			close(started)
+			<-release
+			return data, nil
+		}
+
+		mutex.Lock()
+		order = append(order, data.(string))
+		mutex.Unlock()
+		return data, nil
+	})
+	go workerQueue.Run()
+
+	// Occupy the worker so that the following jobs stay buffered
+	go workerQueue.Process(context.Background(), "busy")
+	<-started
+
+	var wg sync.WaitGroup
+	enqueue := func(client string, weight int, count int) {
+		ctx := queue.WithClient(context.Background(), client, weight)
+		for i := 0; i < count; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				workerQueue.Process(ctx, client)
+			}()
+		}
+	}
+
+	enqueue("a", 1, 4)
+	for workerQueue.Len() < 4 {
+		runtime.Gosched()
+	}
+
+	enqueue("b", 2, 4)
+	for workerQueue.Len() < 8 {
+		runtime.Gosched()
+	}
+
+	close(release)
+	wg.Wait()
+
+	expected := []string{"a", "b", "b", "a", "b", "b", "a", "a"}
+	if !reflect.DeepEqual(order, expected) {
+		t.Fatalf("wrong processing order %v", order)
+	}
+}
+
+func TestDeadline(t *testing.T) {
+	workerQueue, cancel := setupQueue(func(ctx context.Context, data interface{}) (interface{}, error) {
+		time.Sleep(50 * time.Millisecond)
+		return data, nil
+	})
+
+	defer cancel()
+
+	_, err := workerQueue.Process(context.Background(), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Jobs that would time out before they're done processing fail fast
+	ctx, ctxCancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer ctxCancel()
+
+	_, err = workerQueue.Process(ctx, "test")
+	if !errors.Is(err, queue.ErrDropped) {
+		t.Fatalf("wrong error %s", err)
+	}
+}
+
+func TestPanic(t *testing.T) {
+	workerQueue, cancel := setupQueue(func(ctx context.Context, data interface{}) (interface{}, error) {
+		if data == "panic" {
+			panic("custom panic")
+		}
+
+		return data, nil
+	})
+
+	defer cancel()
+
+	for i := 0; i < 5; i++ {
+		_, err := workerQueue.Process(context.Background(), "panic")
+
+		var panicErr *queue.PanicError
+		if !errors.As(err, &panicErr) || panicErr.Value != "custom panic" {
+			t.Fatalf("wrong error %s", err)
+		}
+	}
+
+	// The workers that panicked have been replaced
+	data, err := workerQueue.Process(context.Background(), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if data != "test" {
+		t.Fatal("wrong data")
+	}
+}
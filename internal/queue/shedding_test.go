@@ -0,0 +1,82 @@
+package queue
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// The load shedding decisions only depend on the time and the wait time, so we can simulate a backed up queue without waiting for it
+func TestShedding(t *testing.T) {
+	q := &Queue{length: 100}
+	j := job{context: context.Background()}
+	start := time.Now()
+
+	// shed simulates dequeueing a job every step for the duration, with every job having waited for wait, returning the drop reasons
+	now := start
+	shed := func(duration time.Duration, wait time.Duration) map[string]int {
+		reasons := make(map[string]int)
+		for end := now.Add(duration); now.Before(end); now = now.Add(10 * time.Millisecond) {
+			if reason := q.dropReason(j, now, wait); reason != "" {
+				reasons[reason]++
+			}
+		}
+
+		return reasons
+	}
+
+	t.Run("doesn't drop jobs while the wait time is below the target", func(t *testing.T) {
+		if reasons := shed(time.Minute, codelTarget/2); len(reasons) != 0 {
+			t.Errorf("dropped jobs %v", reasons)
+		}
+	})
+
+	t.Run("doesn't drop jobs until the wait time has been above the target for an interval", func(t *testing.T) {
+		if reasons := shed(codelInterval, 2*codelTarget); len(reasons) != 0 {
+			t.Errorf("dropped jobs %v", reasons)
+		}
+	})
+
+	t.Run("drops jobs at an increasing rate while the wait time stays above the target", func(t *testing.T) {
+		first := shed(codelInterval, 2*codelTarget)[dropCoDel]
+		second := shed(codelInterval, 2*codelTarget)[dropCoDel]
+
+		if first == 0 {
+			t.Fatal("didn't drop any jobs")
+		}
+
+		if second <= first {
+			t.Errorf("drop rate didn't increase, %d then %d", first, second)
+		}
+	})
+
+	t.Run("stops dropping jobs once the queue drains", func(t *testing.T) {
+		q.length = 0
+		if reasons := shed(time.Second, 2*codelTarget); len(reasons) != 0 {
+			t.Errorf("dropped jobs %v", reasons)
+		}
+
+		// It takes another full interval above the target to start dropping again
+		q.length = 100
+		if reasons := shed(codelInterval, 2*codelTarget); len(reasons) != 0 {
+			t.Errorf("dropped jobs %v", reasons)
+		}
+
+		if reasons := shed(codelInterval, 2*codelTarget); reasons[dropCoDel] == 0 {
+			t.Error("didn't drop any jobs")
+		}
+	})
+
+	t.Run("stops dropping jobs once the wait time goes below the target", func(t *testing.T) {
+		if reasons := shed(time.Second, codelTarget/2); len(reasons) != 0 {
+			t.Errorf("dropped jobs %v", reasons)
+		}
+	})
+
+	t.Run("always drops jobs that have waited too long", func(t *testing.T) {
+		q.length = 0
+		if reasons := shed(time.Second, maxWait+time.Second); reasons[dropMaxWait] != 100 {
+			t.Errorf("wrong drops %v", reasons)
+		}
+	})
+}
@@ -0,0 +1,49 @@
+package retry
+
+import (
+	"context"
+	"expvar"
+	"math/rand/v2"
+	"time"
+)
+
+// Policy describes how an operation is retried
+type Policy struct {
+	// How many times a failed operation is retried
+	Retries int
+	// The delay before the first retry, doubled for each retry after that
+	Backoff time.Duration
+	// Whether an operation that failed with the error may succeed if retried
+	Retryable func(err error) bool
+	// Counter incremented for every retry, may be nil
+	Counter *expvar.Int
+}
+
+// Do calls fn until it succeeds, fails with an error that isn't retryable, or runs out of retries
+// Retries stop early when the context is done, returning the context error
+func (p Policy) Do(ctx context.Context, fn func() error) error {
+	backoff := p.Backoff
+	for attempt := 0; ; attempt++ {
+		err := fn()
+		if err == nil || attempt == p.Retries || ctx.Err() != nil || !p.Retryable(err) {
+			return err
+		}
+
+		if p.Counter != nil {
+			p.Counter.Add(1)
+		}
+
+		// Add jitter, so that clients that failed at the same time don't retry at the same time
+		delay := backoff / 2
+		if backoff > 0 {
+			delay += rand.N(backoff)
+		}
+		backoff *= 2
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
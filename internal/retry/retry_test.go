@@ -0,0 +1,85 @@
+package retry_test
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"testing"
+	"time"
+
+	"github.com/DMarby/picsum-photos/internal/retry"
+)
+
+var (
+	errTemporary = errors.New("temporary")
+	errPermanent = errors.New("permanent")
+)
+
+func TestRetry(t *testing.T) {
+	ctx := context.Background()
+
+	counter := new(expvar.Int)
+	policy := retry.Policy{
+		Retries:   2,
+		Backoff:   time.Millisecond,
+		Retryable: func(err error) bool { return err == errTemporary },
+		Counter:   counter,
+	}
+
+	t.Run("retries until success", func(t *testing.T) {
+		calls := 0
+		err := policy.Do(ctx, func() error {
+			calls++
+			if calls < 3 {
+				return errTemporary
+			}
+			return nil
+		})
+
+		if err != nil || calls != 3 {
+			t.Errorf("wrong result %v after %d calls", err, calls)
+		}
+	})
+
+	t.Run("gives up after the retries", func(t *testing.T) {
+		calls := 0
+		err := policy.Do(ctx, func() error {
+			calls++
+			return errTemporary
+		})
+
+		if err != errTemporary || calls != 3 {
+			t.Errorf("wrong result %v after %d calls", err, calls)
+		}
+	})
+
+	t.Run("doesn't retry permanent errors", func(t *testing.T) {
+		calls := 0
+		err := policy.Do(ctx, func() error {
+			calls++
+			return errPermanent
+		})
+
+		if err != errPermanent || calls != 1 {
+			t.Errorf("wrong result %v after %d calls", err, calls)
+		}
+	})
+
+	t.Run("stops when the context is done", func(t *testing.T) {
+		cancelCtx, cancel := context.WithCancel(ctx)
+		calls := 0
+		err := policy.Do(cancelCtx, func() error {
+			calls++
+			cancel()
+			return errTemporary
+		})
+
+		if err != errTemporary || calls != 1 {
+			t.Errorf("wrong result %v after %d calls", err, calls)
+		}
+	})
+
+	if counter.Value() != 4 {
+		t.Errorf("wrong retry count %d", counter.Value())
+	}
+}
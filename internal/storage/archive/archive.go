@@ -0,0 +1,167 @@
+package archive
+
+import (
+	"archive/zip"
+	"context"
+	"expvar"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/DMarby/picsum-photos/internal/logger"
+	"github.com/DMarby/picsum-photos/internal/storage"
+	"github.com/DMarby/picsum-photos/internal/watch"
+)
+
+var (
+	reloads      = expvar.NewInt("counter_storage_archive_reloads")
+	reloadErrors = expvar.NewInt("counter_storage_archive_reload_errors")
+)
+
+// Provider implements an image storage serving images from a single zip archive, such as one built by cmd/image-archive
+// The archive can be replaced while the provider is in use, see Reload and Watch
+type Provider struct {
+	path string
+
+	mutex   sync.RWMutex
+	archive *archive
+}
+
+// archive is an open zip archive, indexed by file name
+type archive struct {
+	file    *os.File
+	info    os.FileInfo
+	entries map[string]*zip.File
+}
+
+// New returns a new Provider instance for the archive at path
+func New(path string) (*Provider, error) {
+	archive, err := open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &Provider{
+		path:    path,
+		archive: archive,
+	}
+
+	if expvar.Get("gauge_storage_archive_images") == nil {
+		expvar.Publish("gauge_storage_archive_images", expvar.Func(func() any {
+			return p.Len()
+		}))
+	}
+
+	return p, nil
+}
+
+func open(path string) (*archive, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	reader, err := zip.NewReader(file, info.Size())
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("error reading archive %s: %w", path, err)
+	}
+
+	entries := make(map[string]*zip.File, len(reader.File))
+	for _, entry := range reader.File {
+		entries[entry.Name] = entry
+	}
+
+	return &archive{
+		file:    file,
+		info:    info,
+		entries: entries,
+	}, nil
+}
+
+// Get returns the image data for an image id
+func (p *Provider) Get(ctx context.Context, id string) ([]byte, error) {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+
+	entry, ok := p.archive.entries[id+".jpg"]
+	if !ok {
+		return nil, storage.ErrNotFound
+	}
+
+	// Uncompressed images are read directly from the archive, without going through the zip reader
+	if entry.Method == zip.Store {
+		offset, err := entry.DataOffset()
+		if err != nil {
+			return nil, err
+		}
+
+		data := make([]byte, entry.UncompressedSize64)
+		if _, err := p.archive.file.ReadAt(data, offset); err != nil {
+			return nil, err
+		}
+
+		return data, nil
+	}
+
+	reader, err := entry.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	return io.ReadAll(reader)
+}
+
+// Len returns the number of files in the archive
+func (p *Provider) Len() int {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+
+	return len(p.archive.entries)
+}
+
+// Reload opens the archive again, swapping it in once it has been read successfully
+// If the new archive can't be read, the provider keeps serving the old one
+func (p *Provider) Reload() error {
+	archive, err := open(p.path)
+	if err != nil {
+		reloadErrors.Add(1)
+		return err
+	}
+
+	p.mutex.Lock()
+	old := p.archive
+	p.archive = archive
+	p.mutex.Unlock()
+
+	reloads.Add(1)
+	return old.file.Close()
+}
+
+// Watch reloads the archive when it changes, checking it every interval until the context is done
+// The archive should be replaced by renaming a new file over it, rather than by writing to it in place
+func (p *Provider) Watch(ctx context.Context, log *logger.Logger, interval time.Duration) {
+	watch.File(ctx, log, p.path, interval, func() os.FileInfo {
+		p.mutex.RLock()
+		defer p.mutex.RUnlock()
+
+		return p.archive.info
+	}, p.Reload)
+}
+
+// Close closes the archive
+func (p *Provider) Close() error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	return p.archive.file.Close()
+}
@@ -0,0 +1,133 @@
+package archive_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/DMarby/picsum-photos/internal/logger"
+	"github.com/DMarby/picsum-photos/internal/storage"
+	"github.com/DMarby/picsum-photos/internal/storage/archive"
+	"go.uber.org/zap"
+)
+
+// build builds an archive from the directory, and renames it to path
+func build(t *testing.T, dir string, path string) {
+	t.Helper()
+
+	file, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := archive.Build(file, dir); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := file.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Rename(file.Name(), path); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestArchive(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "images.zip")
+	build(t, "../../../test/fixtures/file", path)
+
+	provider, err := archive.New(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer provider.Close()
+
+	t.Run("Get an image by id", func(t *testing.T) {
+		buf, err := provider.Get(context.Background(), "1")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		resultFixture, _ := os.ReadFile("../../../test/fixtures/file/1.jpg")
+		if !reflect.DeepEqual(buf, resultFixture) {
+			t.Error("image data doesn't match")
+		}
+	})
+
+	t.Run("Only archives images", func(t *testing.T) {
+		if provider.Len() != 3 {
+			t.Errorf("wrong number of images %d", provider.Len())
+		}
+	})
+
+	t.Run("Returns error on a nonexistant archive", func(t *testing.T) {
+		if _, err := archive.New("nonexistant.zip"); err == nil {
+			t.FailNow()
+		}
+	})
+
+	t.Run("Returns error on a nonexistant image", func(t *testing.T) {
+		_, err := provider.Get(context.Background(), "nonexistant")
+		if err != storage.ErrNotFound {
+			t.FailNow()
+		}
+	})
+}
+
+func TestReload(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	log := logger.New(zap.FatalLevel)
+	defer log.Sync()
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "images.zip")
+
+	images := t.TempDir()
+	os.WriteFile(filepath.Join(images, "1.jpg"), []byte("old"), 0644)
+	build(t, images, path)
+
+	provider, err := archive.New(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer provider.Close()
+
+	go provider.Watch(ctx, log, 10*time.Millisecond)
+
+	// An invalid archive is ignored, and the old one keeps being served
+	invalid := filepath.Join(dir, "invalid.zip")
+	os.WriteFile(invalid, []byte("invalid"), 0644)
+	os.Rename(invalid, path)
+
+	if err := provider.Reload(); err == nil {
+		t.Error("no error reloading an invalid archive")
+	}
+
+	if buf, err := provider.Get(ctx, "1"); err != nil || string(buf) != "old" {
+		t.Fatalf("wrong result %s %v", buf, err)
+	}
+
+	// A new archive is swapped in
+	os.WriteFile(filepath.Join(images, "1.jpg"), []byte("new"), 0644)
+	os.WriteFile(filepath.Join(images, "2.jpg"), []byte("added"), 0644)
+	build(t, images, path)
+
+	deadline := time.Now().Add(time.Second)
+	for provider.Len() != 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if buf, err := provider.Get(ctx, "1"); err != nil || string(buf) != "new" {
+		t.Errorf("wrong result %s %v", buf, err)
+	}
+
+	if buf, err := provider.Get(ctx, "2"); err != nil || string(buf) != "added" {
+		t.Errorf("wrong result %s %v", buf, err)
+	}
+}
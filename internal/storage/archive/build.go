@@ -0,0 +1,59 @@
+package archive
+
+import (
+	"archive/zip"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// Build writes an archive with all the jpg images in the directory to w, returning the number of images
+// Images are stored uncompressed, as jpg images don't compress further, so that they can be read directly from the archive
+func Build(w io.Writer, dir string) (int, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.jpg"))
+	if err != nil {
+		return 0, err
+	}
+	sort.Strings(paths)
+
+	writer := zip.NewWriter(w)
+	for _, path := range paths {
+		if err := add(writer, path); err != nil {
+			return 0, err
+		}
+	}
+
+	if err := writer.Close(); err != nil {
+		return 0, err
+	}
+
+	return len(paths), nil
+}
+
+func add(writer *zip.Writer, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	header, err := zip.FileInfoHeader(info)
+	if err != nil {
+		return err
+	}
+	header.Method = zip.Store
+
+	entry, err := writer.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(entry, file)
+	return err
+}
@@ -0,0 +1,75 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"expvar"
+)
+
+var (
+	writeBacks      = expvar.NewInt("counter_storage_chain_write_backs")
+	writeBackErrors = expvar.NewInt("counter_storage_chain_write_back_errors")
+)
+
+// Chain is a storage made up of an ordered chain of providers, such as local disk, S3 and an HTTP origin
+type Chain struct {
+	Providers []Provider // from the preferred to the least preferred
+	// Whether images found in a provider are written back to the first writable provider before it
+	WriteBack bool
+	// Checks images before they're written back, so that corrupt images aren't stored, nil disables it
+	Verifier Verifier
+}
+
+// Get returns the image data from the first provider that has the image
+// Providers that fail are skipped, the error is only returned if no provider has the image
+func (c *Chain) Get(ctx context.Context, id string) ([]byte, error) {
+	var errs []error
+	for i, provider := range c.Providers {
+		data, err := provider.Get(ctx, id)
+		if err == ErrNotFound {
+			continue
+		}
+
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		if c.WriteBack && i > 0 {
+			// Try the next provider rather than storing a corrupt image
+			if c.Verifier != nil {
+				if err := c.Verifier.Verify(id, data); err != nil {
+					errs = append(errs, err)
+					continue
+				}
+			}
+
+			c.writeBack(ctx, c.Providers[:i], id, data)
+		}
+
+		return data, nil
+	}
+
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+
+	return nil, ErrNotFound
+}
+
+// writeBack stores the image in the first writable provider, write-back is best effort so errors are only counted
+func (c *Chain) writeBack(ctx context.Context, providers []Provider, id string, data []byte) {
+	for _, provider := range providers {
+		writer, ok := provider.(Writer)
+		if !ok {
+			continue
+		}
+
+		writeBacks.Add(1)
+		if err := writer.Put(ctx, id, data); err != nil {
+			writeBackErrors.Add(1)
+		}
+
+		return
+	}
+}
@@ -0,0 +1,143 @@
+package storage_test
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"testing"
+
+	"github.com/DMarby/picsum-photos/internal/storage"
+)
+
+// mapProvider is a writable storage keeping images in a map
+type mapProvider map[string][]byte
+
+func (p mapProvider) Get(ctx context.Context, id string) ([]byte, error) {
+	data, ok := p[id]
+	if !ok {
+		return nil, storage.ErrNotFound
+	}
+
+	return data, nil
+}
+
+func (p mapProvider) Put(ctx context.Context, id string, data []byte) error {
+	p[id] = data
+	return nil
+}
+
+// readOnlyProvider hides the Put method of the provider
+type readOnlyProvider struct {
+	storage.Provider
+}
+
+// failingProvider is a storage that is unavailable
+type failingProvider struct{}
+
+var errUnavailable = errors.New("unavailable")
+
+func (p failingProvider) Get(ctx context.Context, id string) ([]byte, error) {
+	return nil, errUnavailable
+}
+
+func TestChain(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("Get an image from the first provider that has it", func(t *testing.T) {
+		local := mapProvider{}
+		remote := mapProvider{"1": []byte("remote")}
+		chain := &storage.Chain{Providers: []storage.Provider{local, failingProvider{}, remote}}
+
+		data, err := chain.Get(ctx, "1")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(data) != "remote" {
+			t.Errorf("wrong data %s", data)
+		}
+
+		if _, ok := local["1"]; ok {
+			t.Error("image was written back without write-back enabled")
+		}
+	})
+
+	t.Run("Writes back to the first writable provider", func(t *testing.T) {
+		first := mapProvider{}
+		local := mapProvider{}
+		remote := mapProvider{"1": []byte("remote")}
+		chain := &storage.Chain{
+			Providers: []storage.Provider{readOnlyProvider{first}, local, remote},
+			WriteBack: true,
+		}
+
+		if _, err := chain.Get(ctx, "1"); err != nil {
+			t.Fatal(err)
+		}
+
+		if string(local["1"]) != "remote" {
+			t.Error("image wasn't written back")
+		}
+
+		if _, ok := first["1"]; ok {
+			t.Error("image was written back to a read-only provider")
+		}
+	})
+
+	t.Run("Verifies images before writing them back", func(t *testing.T) {
+		hash := sha256.Sum256([]byte("image"))
+		verifier := &storage.Verified{Checksums: map[string]string{"1": hex.EncodeToString(hash[:])}}
+
+		local := mapProvider{}
+		corrupt := mapProvider{"1": []byte("truncated")}
+		remote := mapProvider{"1": []byte("image")}
+		chain := &storage.Chain{
+			Providers: []storage.Provider{local, corrupt, remote},
+			WriteBack: true,
+			Verifier:  verifier,
+		}
+
+		data, err := chain.Get(ctx, "1")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(data) != "image" {
+			t.Errorf("wrong data %s", data)
+		}
+
+		if string(local["1"]) != "image" {
+			t.Errorf("wrong data written back %s", local["1"])
+		}
+
+		// The image is corrupt everywhere
+		delete(local, "1")
+		chain.Providers = []storage.Provider{local, corrupt}
+
+		var checksumErr *storage.ChecksumError
+		if _, err := chain.Get(ctx, "1"); !errors.As(err, &checksumErr) {
+			t.Errorf("wrong error %v", err)
+		}
+
+		if _, ok := local["1"]; ok {
+			t.Error("corrupt image was written back")
+		}
+	})
+
+	t.Run("Returns not found if no provider has the image", func(t *testing.T) {
+		chain := &storage.Chain{Providers: []storage.Provider{mapProvider{}, mapProvider{}}}
+
+		if _, err := chain.Get(ctx, "1"); err != storage.ErrNotFound {
+			t.Errorf("wrong error %v", err)
+		}
+	})
+
+	t.Run("Returns the error if a provider failed", func(t *testing.T) {
+		chain := &storage.Chain{Providers: []storage.Provider{mapProvider{}, failingProvider{}}}
+
+		if _, err := chain.Get(ctx, "1"); !errors.Is(err, errUnavailable) {
+			t.Errorf("wrong error %v", err)
+		}
+	})
+}
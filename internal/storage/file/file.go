@@ -7,6 +7,7 @@ import (
 	"os"
 	"path/filepath"
 
+	"github.com/DMarby/picsum-photos/internal/atomicfile"
 	"github.com/DMarby/picsum-photos/internal/storage"
 )
 
@@ -39,3 +40,9 @@ func (p *Provider) Get(ctx context.Context, id string) ([]byte, error) {
 
 	return imageData, nil
 }
+
+// Put stores the image data for an image id
+// The data is written to a temporary file first, so that readers never see a partially written image
+func (p *Provider) Put(ctx context.Context, id string, data []byte) error {
+	return atomicfile.WriteFile(filepath.Join(p.path, fmt.Sprintf("%s.jpg", id)), data, 0600)
+}
@@ -42,4 +42,24 @@ func TestFile(t *testing.T) {
 			t.FailNow()
 		}
 	})
+
+	t.Run("Put an image", func(t *testing.T) {
+		provider, err := file.New(t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := provider.Put(context.Background(), "2", []byte("image")); err != nil {
+			t.Fatal(err)
+		}
+
+		buf, err := provider.Get(context.Background(), "2")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(buf) != "image" {
+			t.Error("image data doesn't match")
+		}
+	})
 }
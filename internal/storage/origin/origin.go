@@ -0,0 +1,160 @@
+package origin
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/DMarby/picsum-photos/internal/breaker"
+	"github.com/DMarby/picsum-photos/internal/retry"
+	"github.com/DMarby/picsum-photos/internal/storage"
+)
+
+// The placeholder for the image id in the url template
+const idPlaceholder = "{id}"
+
+// ErrUnavailable is returned without contacting the origin while the circuit breaker is open
+var ErrUnavailable = errors.New("origin is unavailable")
+
+var (
+	breakerOpens      = expvar.NewInt("counter_storage_origin_breaker_opens")
+	breakerRejections = expvar.NewInt("counter_storage_origin_breaker_rejections")
+)
+
+var retryPolicy = retry.Policy{
+	Retries:   2,
+	Backoff:   100 * time.Millisecond,
+	Retryable: retryable,
+	Counter:   expvar.NewInt("counter_storage_origin_retries"),
+}
+
+// Provider implements an image storage fetching images from an upstream HTTP origin
+type Provider struct {
+	template string
+	client   *http.Client
+	breaker  *breaker.Breaker
+}
+
+// StatusError is returned when the origin responds with an unexpected status code
+type StatusError struct {
+	StatusCode int
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("origin responded with status %d", e.StatusCode)
+}
+
+// New returns a new Provider instance for the url template, such as https://origin.example.com/images/{id}.jpg
+// Requests time out after timeout, and after failureThreshold consecutive failures
+// the origin is considered to be down, failing requests immediately until cooldown has passed
+func New(template string, timeout time.Duration, failureThreshold int, cooldown time.Duration) (*Provider, error) {
+	if !strings.Contains(template, idPlaceholder) {
+		return nil, fmt.Errorf("invalid url template %s, missing %s", template, idPlaceholder)
+	}
+
+	templateURL, err := url.Parse(strings.ReplaceAll(template, idPlaceholder, "id"))
+	if err != nil {
+		return nil, err
+	}
+
+	if templateURL.Scheme != "http" && templateURL.Scheme != "https" {
+		return nil, fmt.Errorf("invalid url template %s, expected a http or https url", template)
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConns = 100
+	transport.MaxIdleConnsPerHost = 100
+
+	return &Provider{
+		template: template,
+		client: &http.Client{
+			Transport: transport,
+			Timeout:   timeout,
+		},
+		breaker: &breaker.Breaker{
+			Threshold: failureThreshold,
+			Cooldown:  cooldown,
+		},
+	}, nil
+}
+
+// Get returns the image data for an image id
+// Requests that fail with a server error or a network error are retried with exponential backoff
+func (p *Provider) Get(ctx context.Context, id string) (data []byte, err error) {
+	generation, ok := p.breaker.Allow()
+	if !ok {
+		breakerRejections.Add(1)
+		return nil, ErrUnavailable
+	}
+
+	err = retryPolicy.Do(ctx, func() error {
+		data, err = p.get(ctx, id)
+		return err
+	})
+
+	switch {
+	case err == nil, errors.Is(err, storage.ErrNotFound):
+		p.breaker.Success(generation)
+	case ctx.Err() != nil, !originFailure(err):
+		// The origin didn't fail, the request was cancelled or rejected
+		p.breaker.Release(generation)
+	default:
+		if p.breaker.Failure(generation) {
+			breakerOpens.Add(1)
+		}
+	}
+
+	return data, err
+}
+
+func (p *Provider) get(ctx context.Context, id string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.ReplaceAll(p.template, idPlaceholder, url.PathEscape(id)), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusOK:
+		return io.ReadAll(res.Body)
+	case http.StatusNotFound:
+		return nil, storage.ErrNotFound
+	default:
+		// Drain the body, so that the connection can be reused
+		io.Copy(io.Discard, io.LimitReader(res.Body, 64<<10))
+		return nil, &StatusError{StatusCode: res.StatusCode}
+	}
+}
+
+// originFailure returns whether the error means that the origin is failing, rather than that the request was rejected, such as a 403
+func originFailure(err error) bool {
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode >= 500
+	}
+
+	// Network errors
+	return true
+}
+
+// retryable returns whether a request that failed with the error may succeed if retried
+func retryable(err error) bool {
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode >= 500 || statusErr.StatusCode == http.StatusTooManyRequests
+	}
+
+	// Network errors
+	return !errors.Is(err, storage.ErrNotFound)
+}
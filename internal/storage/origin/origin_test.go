@@ -0,0 +1,145 @@
+package origin_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/DMarby/picsum-photos/internal/storage"
+	"github.com/DMarby/picsum-photos/internal/storage/origin"
+)
+
+// fakeOrigin serves image 1, and responds with a server error while down is set
+func fakeOrigin(t *testing.T) (*httptest.Server, *atomic.Bool, *atomic.Int32) {
+	t.Helper()
+
+	var down atomic.Bool
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+
+		if down.Load() {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+
+		if r.URL.Path == "/images/forbidden.jpg" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		if r.URL.Path != "/images/1.jpg" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		w.Write([]byte("image"))
+	}))
+	t.Cleanup(server.Close)
+
+	return server, &down, &requests
+}
+
+func TestOrigin(t *testing.T) {
+	ctx := context.Background()
+
+	server, _, _ := fakeOrigin(t)
+
+	provider, err := origin.New(server.URL+"/images/{id}.jpg", time.Second, 5, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("Get an image by id", func(t *testing.T) {
+		buf, err := provider.Get(ctx, "1")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(buf) != "image" {
+			t.Error("image data doesn't match")
+		}
+	})
+
+	t.Run("Returns error on a nonexistant image", func(t *testing.T) {
+		_, err := provider.Get(ctx, "nonexistant")
+		if err != storage.ErrNotFound {
+			t.Fatalf("wrong error %v", err)
+		}
+	})
+
+	t.Run("Returns error on an invalid template", func(t *testing.T) {
+		if _, err := origin.New(server.URL+"/images/1.jpg", time.Second, 5, time.Minute); err == nil {
+			t.Error("no error for template without id")
+		}
+
+		if _, err := origin.New("localhost/{id}.jpg", time.Second, 5, time.Minute); err == nil {
+			t.Error("no error for template without scheme")
+		}
+	})
+}
+
+func TestBreaker(t *testing.T) {
+	ctx := context.Background()
+
+	server, down, requests := fakeOrigin(t)
+
+	provider, err := origin.New(server.URL+"/images/{id}.jpg", time.Second, 2, 100*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Client errors don't mean that the origin is down
+	for i := 0; i < 5; i++ {
+		provider.Get(ctx, "forbidden")
+		provider.Get(ctx, "nonexistant")
+	}
+
+	if _, err := provider.Get(ctx, "1"); err != nil {
+		t.Fatalf("breaker opened on client errors %v", err)
+	}
+	requests.Store(0)
+
+	down.Store(true)
+
+	// Each request is retried before it counts as a failure
+	for i := 0; i < 2; i++ {
+		_, err := provider.Get(ctx, "1")
+		if statusErr, ok := err.(*origin.StatusError); !ok || statusErr.StatusCode != http.StatusBadGateway {
+			t.Fatalf("wrong error %v", err)
+		}
+	}
+
+	if count := requests.Load(); count != 6 {
+		t.Errorf("wrong number of requests %d", count)
+	}
+
+	// The breaker is open, so requests fail without reaching the origin
+	if _, err := provider.Get(ctx, "1"); err != origin.ErrUnavailable {
+		t.Fatalf("wrong error %v", err)
+	}
+
+	if count := requests.Load(); count != 6 {
+		t.Errorf("request reached the origin while the breaker was open")
+	}
+
+	// After the cooldown a request is let through, closing the breaker once the origin has recovered
+	down.Store(false)
+	time.Sleep(150 * time.Millisecond)
+
+	buf, err := provider.Get(ctx, "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(buf) != "image" {
+		t.Error("image data doesn't match")
+	}
+
+	if _, err := provider.Get(ctx, "1"); err != nil {
+		t.Errorf("breaker didn't close %v", err)
+	}
+}
@@ -0,0 +1,134 @@
+package s3
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/DMarby/picsum-photos/internal/retry"
+	"github.com/DMarby/picsum-photos/internal/storage"
+)
+
+// How long a single request may take
+const requestTimeout = 30 * time.Second
+
+var retryPolicy = retry.Policy{
+	Retries:   3,
+	Backoff:   100 * time.Millisecond,
+	Retryable: retryable,
+	Counter:   expvar.NewInt("counter_storage_s3_retries"),
+}
+
+// Provider implements an image storage using an S3-compatible object storage
+type Provider struct {
+	endpoint        *url.URL
+	region          string
+	bucket          string
+	prefix          string
+	accessKeyID     string
+	secretAccessKey string
+	client          *http.Client
+}
+
+// Error is an error response from the object storage
+type Error struct {
+	StatusCode int
+	Code       string `xml:"Code"`
+	Message    string `xml:"Message"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("s3 error %d %s: %s", e.StatusCode, e.Code, e.Message)
+}
+
+// New returns a new Provider instance for the bucket at the endpoint, such as https://s3.us-east-1.amazonaws.com
+// Images are stored as {prefix}{id}.jpg, and objects are addressed using path-style URLs
+// If accessKeyID is empty, requests are sent without credentials, for public buckets
+func New(endpoint string, region string, bucket string, prefix string, accessKeyID string, secretAccessKey string) (*Provider, error) {
+	endpointURL, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	if endpointURL.Scheme != "http" && endpointURL.Scheme != "https" {
+		return nil, fmt.Errorf("invalid endpoint %s, expected a http or https url", endpoint)
+	}
+
+	if bucket == "" {
+		return nil, fmt.Errorf("missing bucket")
+	}
+
+	return &Provider{
+		endpoint:        endpointURL,
+		region:          region,
+		bucket:          bucket,
+		prefix:          prefix,
+		accessKeyID:     accessKeyID,
+		secretAccessKey: secretAccessKey,
+		client: &http.Client{
+			Timeout: requestTimeout,
+		},
+	}, nil
+}
+
+// Get returns the image data for an image id
+// Requests that fail with a server error or a network error are retried with exponential backoff
+func (p *Provider) Get(ctx context.Context, id string) (data []byte, err error) {
+	err = retryPolicy.Do(ctx, func() error {
+		data, err = p.get(ctx, id)
+		return err
+	})
+	return data, err
+}
+
+func (p *Provider) get(ctx context.Context, id string) ([]byte, error) {
+	objectURL := *p.endpoint
+	objectURL.Path = strings.TrimSuffix(objectURL.Path, "/") + "/" + p.bucket + "/" + p.prefix + id + ".jpg"
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, objectURL.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if p.accessKeyID != "" {
+		sign(req, p.accessKeyID, p.secretAccessKey, p.region, time.Now())
+	}
+
+	res, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		s3Err := &Error{StatusCode: res.StatusCode}
+		body, _ := io.ReadAll(io.LimitReader(res.Body, 64<<10))
+		xml.Unmarshal(body, s3Err)
+
+		if s3Err.Code == "NoSuchKey" || (s3Err.Code == "" && res.StatusCode == http.StatusNotFound) {
+			return nil, storage.ErrNotFound
+		}
+
+		return nil, s3Err
+	}
+
+	return io.ReadAll(res.Body)
+}
+
+// retryable returns whether a request that failed with the error may succeed if retried
+func retryable(err error) bool {
+	var s3Err *Error
+	if errors.As(err, &s3Err) {
+		return s3Err.StatusCode >= 500 || s3Err.StatusCode == http.StatusTooManyRequests
+	}
+
+	// Network errors
+	return !errors.Is(err, storage.ErrNotFound)
+}
@@ -0,0 +1,161 @@
+package s3_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/DMarby/picsum-photos/internal/storage"
+	"github.com/DMarby/picsum-photos/internal/storage/s3"
+)
+
+const noSuchKey = `<?xml version="1.0" encoding="UTF-8"?>
+<Error><Code>NoSuchKey</Code><Message>The specified key does not exist.</Message></Error>`
+
+// fakeS3 is a stand-in for an S3-compatible object storage, serving the objects in a single bucket
+func fakeS3(t *testing.T, objects map[string]string, failures int32) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		count := requests.Add(1)
+
+		auth := r.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential=key/") || !strings.Contains(auth, "/us-east-1/s3/aws4_request, SignedHeaders=host;x-amz-content-sha256;x-amz-date, Signature=") {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		if count <= failures {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		data, ok := objects[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(noSuchKey))
+			return
+		}
+
+		w.Write([]byte(data))
+	}))
+	t.Cleanup(server.Close)
+
+	return server, &requests
+}
+
+func TestS3(t *testing.T) {
+	ctx := context.Background()
+
+	server, _ := fakeS3(t, map[string]string{
+		"/bucket/images/1.jpg": "image",
+	}, 0)
+
+	provider, err := s3.New(server.URL, "us-east-1", "bucket", "images/", "key", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("Get an image by id", func(t *testing.T) {
+		buf, err := provider.Get(ctx, "1")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(buf) != "image" {
+			t.Error("image data doesn't match")
+		}
+	})
+
+	t.Run("Returns error on a nonexistant image", func(t *testing.T) {
+		_, err := provider.Get(ctx, "nonexistant")
+		if err != storage.ErrNotFound {
+			t.Fatalf("wrong error %v", err)
+		}
+	})
+
+	t.Run("Returns error on an invalid endpoint", func(t *testing.T) {
+		if _, err := s3.New("localhost:9000", "us-east-1", "bucket", "", "", ""); err == nil {
+			t.FailNow()
+		}
+	})
+
+	t.Run("Returns error on wrong credentials", func(t *testing.T) {
+		provider, err := s3.New(server.URL, "eu-west-1", "bucket", "images/", "key", "secret")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = provider.Get(ctx, "1")
+		if s3Err, ok := err.(*s3.Error); !ok || s3Err.StatusCode != http.StatusForbidden {
+			t.Fatalf("wrong error %v", err)
+		}
+	})
+}
+
+func TestRetries(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("Retries server errors", func(t *testing.T) {
+		server, requests := fakeS3(t, map[string]string{
+			"/bucket/1.jpg": "image",
+		}, 2)
+
+		provider, err := s3.New(server.URL, "us-east-1", "bucket", "", "key", "secret")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		buf, err := provider.Get(ctx, "1")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(buf) != "image" {
+			t.Error("image data doesn't match")
+		}
+
+		if count := requests.Load(); count != 3 {
+			t.Errorf("wrong number of requests %d", count)
+		}
+	})
+
+	t.Run("Gives up after too many retries", func(t *testing.T) {
+		server, requests := fakeS3(t, map[string]string{}, 100)
+
+		provider, err := s3.New(server.URL, "us-east-1", "bucket", "", "key", "secret")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = provider.Get(ctx, "1")
+		if s3Err, ok := err.(*s3.Error); !ok || s3Err.StatusCode != http.StatusServiceUnavailable {
+			t.Fatalf("wrong error %v", err)
+		}
+
+		if count := requests.Load(); count != 4 {
+			t.Errorf("wrong number of requests %d", count)
+		}
+	})
+
+	t.Run("Doesn't retry a nonexistant image", func(t *testing.T) {
+		server, requests := fakeS3(t, map[string]string{}, 0)
+
+		provider, err := s3.New(server.URL, "us-east-1", "bucket", "", "key", "secret")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := provider.Get(ctx, "1"); err != storage.ErrNotFound {
+			t.Fatalf("wrong error %v", err)
+		}
+
+		if count := requests.Load(); count != 1 {
+			t.Errorf("wrong number of requests %d", count)
+		}
+	})
+}
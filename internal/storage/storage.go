@@ -10,6 +10,16 @@ type Provider interface {
 	Get(ctx context.Context, id string) ([]byte, error)
 }
 
+// Writer is implemented by providers that images can be stored in
+type Writer interface {
+	Put(ctx context.Context, id string, data []byte) error
+}
+
+// Verifier checks that image data is intact, such as against its checksum
+type Verifier interface {
+	Verify(id string, data []byte) error
+}
+
 // Errors
 var (
 	ErrNotFound = errors.New("Image does not exist")
@@ -0,0 +1,112 @@
+package storage
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"expvar"
+	"fmt"
+	"math/rand/v2"
+	"sync"
+	"time"
+)
+
+// How long a checksum mismatch is reported by IntegrityError
+const mismatchWindow = 10 * time.Minute
+
+var (
+	verifications = expvar.NewInt("counter_storage_checksum_verifications")
+	mismatches    = expvar.NewInt("counter_storage_checksum_mismatches")
+)
+
+// ChecksumError is returned when the data loaded for an image doesn't match its checksum, such as for a truncated file
+type ChecksumError struct {
+	ID       string
+	Expected string
+	Actual   string
+}
+
+func (e *ChecksumError) Error() string {
+	return fmt.Sprintf("checksum mismatch for image %s, expected sha256 %s, got %s", e.ID, e.Expected, e.Actual)
+}
+
+// Verified is a storage that verifies the images loaded from a provider against their checksums
+type Verified struct {
+	Provider  Provider
+	Checksums map[string]string // hex encoded SHA-256 checksums by image id, images without one aren't verified, replace them using SetChecksums
+	// The fraction of loads to verify, from 0 to 1
+	SampleRate float64
+
+	checksumsMutex sync.RWMutex
+
+	mutex        sync.Mutex
+	lastMismatch time.Time
+	lastError    error
+}
+
+// Get returns the image data for an image id, or a ChecksumError if it doesn't match its checksum
+func (v *Verified) Get(ctx context.Context, id string) ([]byte, error) {
+	data, err := v.Provider.Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	if rand.Float64() >= v.SampleRate {
+		return data, nil
+	}
+
+	if err := v.Verify(id, data); err != nil {
+		return nil, err
+	}
+
+	return data, nil
+}
+
+// Verify checks the data for an image against its checksum regardless of the sample rate, returning a ChecksumError if it doesn't match
+func (v *Verified) Verify(id string, data []byte) error {
+	v.checksumsMutex.RLock()
+	expected, ok := v.Checksums[id]
+	v.checksumsMutex.RUnlock()
+	if !ok {
+		return nil
+	}
+
+	verifications.Add(1)
+
+	hash := sha256.Sum256(data)
+	if actual := hex.EncodeToString(hash[:]); actual != expected {
+		mismatches.Add(1)
+
+		err := &ChecksumError{ID: id, Expected: expected, Actual: actual}
+
+		v.mutex.Lock()
+		v.lastMismatch = time.Now()
+		v.lastError = err
+		v.mutex.Unlock()
+
+		return err
+	}
+
+	return nil
+}
+
+// SetChecksums replaces the checksums, such as when the manifest they're from has been reloaded
+func (v *Verified) SetChecksums(checksums map[string]string) {
+	v.checksumsMutex.Lock()
+	defer v.checksumsMutex.Unlock()
+
+	v.Checksums = checksums
+}
+
+// IntegrityError returns the last checksum mismatch, if one happened recently
+// The health checker uses it to surface corrupt images, which are otherwise only seen as image processing errors
+func (v *Verified) IntegrityError() error {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	if time.Since(v.lastMismatch) > mismatchWindow {
+		return nil
+	}
+
+	return v.lastError
+}
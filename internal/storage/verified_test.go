@@ -0,0 +1,95 @@
+package storage_test
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"testing"
+
+	"github.com/DMarby/picsum-photos/internal/storage"
+)
+
+func TestVerified(t *testing.T) {
+	ctx := context.Background()
+
+	hash := sha256.Sum256([]byte("image"))
+	checksum := hex.EncodeToString(hash[:])
+
+	provider := mapProvider{
+		"1":         []byte("image"),
+		"2":         []byte("truncated"),
+		"unchecked": []byte("image"),
+	}
+
+	verified := &storage.Verified{
+		Provider:   provider,
+		Checksums:  map[string]string{"1": checksum, "2": checksum},
+		SampleRate: 1,
+	}
+
+	t.Run("Get an image matching its checksum", func(t *testing.T) {
+		data, err := verified.Get(ctx, "1")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(data) != "image" {
+			t.Errorf("wrong data %s", data)
+		}
+
+		if err := verified.IntegrityError(); err != nil {
+			t.Errorf("unexpected integrity error %v", err)
+		}
+	})
+
+	t.Run("Get an image without a checksum", func(t *testing.T) {
+		if _, err := verified.Get(ctx, "unchecked"); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("Returns error on a checksum mismatch", func(t *testing.T) {
+		_, err := verified.Get(ctx, "2")
+
+		var checksumErr *storage.ChecksumError
+		if !errors.As(err, &checksumErr) || checksumErr.ID != "2" {
+			t.Fatalf("wrong error %v", err)
+		}
+
+		if err := verified.IntegrityError(); err != checksumErr {
+			t.Errorf("wrong integrity error %v", err)
+		}
+	})
+
+	t.Run("Doesn't verify images that aren't sampled", func(t *testing.T) {
+		unsampled := &storage.Verified{
+			Provider:  provider,
+			Checksums: map[string]string{"2": checksum},
+		}
+
+		if _, err := unsampled.Get(ctx, "2"); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("Verifies against replaced checksums", func(t *testing.T) {
+		replaced := &storage.Verified{
+			Provider:   provider,
+			Checksums:  map[string]string{"unchecked": checksum},
+			SampleRate: 1,
+		}
+
+		truncatedHash := sha256.Sum256([]byte("truncated"))
+		replaced.SetChecksums(map[string]string{"2": hex.EncodeToString(truncatedHash[:]), "unchecked": "invalid"})
+
+		if _, err := replaced.Get(ctx, "2"); err != nil {
+			t.Fatal(err)
+		}
+
+		var checksumErr *storage.ChecksumError
+		if _, err := replaced.Get(ctx, "unchecked"); !errors.As(err, &checksumErr) {
+			t.Fatalf("wrong error %v", err)
+		}
+	})
+}
@@ -0,0 +1,50 @@
+package watch
+
+import (
+	"context"
+	"os"
+	"time"
+
+	"github.com/DMarby/picsum-photos/internal/logger"
+)
+
+// File reloads the file at path when it changes, checking it every interval until the context is done
+// current returns the info of the file that is loaded, so that a file that was already reloaded some other way, such as on SIGHUP, isn't reloaded again
+func File(ctx context.Context, log *logger.Logger, path string, interval time.Duration, current func() os.FileInfo, reload func() error) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	// The last file that failed to load, so that the error is only logged once
+	var failed os.FileInfo
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		info, err := os.Stat(path)
+		if err != nil {
+			log.Errorw("error checking file", "path", path, "error", err)
+			continue
+		}
+
+		if Unchanged(info, current()) || (failed != nil && Unchanged(info, failed)) {
+			continue
+		}
+
+		if err := reload(); err != nil {
+			failed = info
+			log.Errorw("error reloading file, keeping the previous one", "path", path, "error", err)
+			continue
+		}
+
+		log.Infow("reloaded file", "path", path)
+	}
+}
+
+// Unchanged returns whether the file info describes the same, unmodified, file
+func Unchanged(info os.FileInfo, previous os.FileInfo) bool {
+	return previous != nil && os.SameFile(info, previous) && info.ModTime().Equal(previous.ModTime()) && info.Size() == previous.Size()
+}
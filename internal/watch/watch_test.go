@@ -0,0 +1,99 @@
+package watch_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/DMarby/picsum-photos/internal/logger"
+	"github.com/DMarby/picsum-photos/internal/watch"
+	"go.uber.org/zap"
+)
+
+func TestFile(t *testing.T) {
+	log := logger.New(zap.FatalLevel)
+	defer log.Sync()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	path := filepath.Join(t.TempDir(), "file")
+	os.WriteFile(path, []byte("first"), 0644)
+
+	var current atomic.Value
+	info, _ := os.Stat(path)
+	current.Store(info)
+
+	var reloads, failures atomic.Int32
+	var fail atomic.Bool
+	go watch.File(ctx, log, path, 10*time.Millisecond, func() os.FileInfo {
+		return current.Load().(os.FileInfo)
+	}, func() error {
+		if fail.Load() {
+			failures.Add(1)
+			return errors.New("invalid file")
+		}
+
+		info, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+
+		current.Store(info)
+		reloads.Add(1)
+		return nil
+	})
+
+	// replace renames a new file over the watched one
+	replace := func(data string) {
+		t.Helper()
+
+		tmp := path + ".tmp"
+		if err := os.WriteFile(tmp, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := os.Rename(tmp, path); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	wait := func(condition func() bool) {
+		t.Helper()
+
+		deadline := time.Now().Add(5 * time.Second)
+		for !condition() {
+			if time.Now().After(deadline) {
+				t.Fatal("timed out")
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+
+	replace("second")
+	wait(func() bool { return reloads.Load() == 1 })
+
+	// An unchanged file isn't reloaded again
+	time.Sleep(50 * time.Millisecond)
+	if reloads.Load() != 1 {
+		t.Errorf("unchanged file was reloaded %d times", reloads.Load())
+	}
+
+	// A file that fails to load is only tried once, until it changes again
+	fail.Store(true)
+	replace("invalid")
+	wait(func() bool { return failures.Load() == 1 })
+
+	time.Sleep(50 * time.Millisecond)
+	if failures.Load() != 1 {
+		t.Errorf("invalid file was reloaded %d times", failures.Load())
+	}
+
+	fail.Store(false)
+	replace("third")
+	wait(func() bool { return reloads.Load() == 2 })
+}